@@ -10,6 +10,8 @@ import (
 
 	"sync"
 
+	"time"
+
 	"github.com/Knetic/govaluate"
 	log "github.com/Sirupsen/logrus"
 )
@@ -21,6 +23,7 @@ type MqttClient interface {
 	Connect() bool
 	Disconnect()
 	SetSubscriptionCallback(callback func(string, string))
+	SetConnectionCallback(callback func(bool))
 	Publish(topic string, qos byte, retained bool, payload interface{}) bool
 	Subscribe(topic string, qos byte) bool
 	Unsubscribe(topics ...string) bool
@@ -47,9 +50,14 @@ type Agent interface {
 	RemoveParameterSubscription(topic string, parameter string)
 
 	AddRuleFromString(ruleset string, rule string, value string)
+	AddRuleFromFormattedString(ruleset string, rule string, format string, value string)
 	AddRule(ruleset string, rule string, r Rule)
 	GetRule(ruleset string, rule string) *Rule
 	AddRuleSubscription(topic string, ruleset string, rule string)
+	AddStateMachine(name string, m StateMachine)
+	AddScene(name string, s Scene)
+	AddTemplate(name string, t RuleTemplate)
+	AddInstance(i RuleInstance)
 	RemoveRuleSubscription(topic string, ruleset string, rule string)
 
 	ExecuteRule(ruleset string, rule string, triggerPayload string)
@@ -68,45 +76,162 @@ type subscriptions struct {
 	//TODO Use slices instead of maps
 	parameters map[string]bool
 	rules      map[rulesKey]bool
+	machines   map[string]bool
+	sequences  map[rulesKey]bool
+}
+
+func (s subscriptions) empty() bool {
+	return len(s.parameters) == 0 && len(s.rules) == 0 && len(s.machines) == 0 && len(s.sequences) == 0
 }
 
 type subscriptionsMap map[string]subscriptions
 
 type agent struct {
+	// Number of values rejected as not matching the parameter definition. Accessed atomically,
+	// so it is kept first for 64-bit alignment.
+	invalidParameterValues uint64
+
 	mqttClient MqttClient
 	messages   chan [2]string
+	incoming   chan message
 	prefix     string
 
 	parameters      parameterMap
 	parameterValues map[string]interface{}
+	histories       map[string]*history
+	freshness       map[string]*freshness
 	rules           rulesMap
 	subscriptions   subscriptionsMap
 
 	regexParam     *regexp.Regexp
 	regexRule      *regexp.Regexp
 	regexSys       *regexp.Regexp
+	regexScene     *regexp.Regexp
 	messagehandler MessageHandler
 
 	rulesMutex sync.Mutex
 	paramMutex sync.Mutex
+
+	started        time.Time
+	connectionLost bool
+	statusMutex    sync.Mutex
+
+	requests      map[*pendingRequest]bool
+	requestsMutex sync.Mutex
+
+	// Messages waiting for space in the incoming buffer while a request blocks Listen
+	overflow      []message
+	overflowMutex sync.Mutex
+
+	scriptTimeout     time.Duration
+	scriptMemoryLimit int
+
+	registry *Registry
+
+	machines      map[string]*stateMachine
+	machinesMutex sync.Mutex
+
+	// Evaluation of state machine conditions, see holdStateMachineConditions
+	conditionsHeld    bool
+	conditionsPending bool
+	conditionsMutex   sync.Mutex
+
+	scenes      map[string]Scene
+	scenesMutex sync.Mutex
+
+	templates      map[string]RuleTemplate
+	templatesMutex sync.Mutex
+
+	// Last values published to the value topics
+	publishedValues        map[string]interface{}
+	publishParameterValues bool
 }
 
+// Number of incoming messages buffered while a rule is executed
+const incomingBufferSize = 100
+
 func (a *agent) initialize() {
 	a.parameters = make(parameterMap)
 	a.parameterValues = make(map[string]interface{})
+	a.histories = make(map[string]*history)
+	a.freshness = make(map[string]*freshness)
+	a.publishedValues = make(map[string]interface{})
 	a.rules = make(rulesMap)
 	a.subscriptions = make(subscriptionsMap)
+	a.requests = make(map[*pendingRequest]bool)
+	a.machines = make(map[string]*stateMachine)
+	a.scenes = make(map[string]Scene)
+	a.templates = make(map[string]RuleTemplate)
+	a.scriptTimeout = DefaultScriptTimeout
+	a.scriptMemoryLimit = DefaultScriptMemoryLimit
+	a.registry = NewRegistry()
 	a.messagehandler = func(topic string, payload string) {
-		a.messages <- [2]string{topic, payload}
+		a.enqueue(message{topic: topic, payload: payload})
 	}
 	a.messages = make(chan [2]string)
+	a.incoming = make(chan message, incomingBufferSize)
+}
+
+func (a *agent) propertiesMessageHandler(topic string, payload string, properties *MessageProperties) {
+	a.enqueue(message{topic: topic, payload: payload, properties: properties})
+}
+
+// enqueue passes an incoming message to Listen. Responses to pending requests are delivered
+// directly, as the rule waiting for them blocks Listen.
+func (a *agent) enqueue(m message) {
+	a.deliverResponse(m)
+	a.overflowMutex.Lock()
+	if len(a.overflow) == 0 {
+		select {
+		case a.incoming <- m:
+			a.overflowMutex.Unlock()
+			return
+		default:
+		}
+		if !a.hasPendingRequests() {
+			a.overflowMutex.Unlock()
+			a.incoming <- m
+			return
+		}
+	}
+	// Do not block the MQTT client while waiting for a response. Once messages overflow, all
+	// following messages are queued behind them to keep their order.
+	a.overflow = append(a.overflow, m)
+	if len(a.overflow) == 1 {
+		go a.drainOverflow()
+	}
+	a.overflowMutex.Unlock()
 }
 
-// Creates and initializes a new MQTT rules client
-func New(mqttClient MqttClient, prefix string) Agent {
+// drainOverflow passes the overflowing messages to Listen in order. The message being passed
+// stays in the queue until it has been accepted, so only one drainOverflow runs at a time.
+func (a *agent) drainOverflow() {
+	a.overflowMutex.Lock()
+	for len(a.overflow) > 0 {
+		m := a.overflow[0]
+		a.overflowMutex.Unlock()
+		a.incoming <- m
+		a.overflowMutex.Lock()
+		a.overflow[0] = message{}
+		a.overflow = a.overflow[1:]
+	}
+	a.overflow = nil
+	a.overflowMutex.Unlock()
+}
+
+// Creates and initializes a new MQTT rules client. An optional registry provides custom
+// expression functions and action types; by default, only the built-ins are available.
+func New(mqttClient MqttClient, prefix string, registry ...*Registry) Agent {
 	a := &agent{}
 	a.initialize()
+	if len(registry) > 0 && registry[0] != nil {
+		a.registry = registry[0]
+	}
 	mqttClient.SetSubscriptionCallback(a.messagehandler)
+	mqttClient.SetConnectionCallback(a.handleConnectionChange)
+	if pc, ok := mqttClient.(PropertiesClient); ok {
+		pc.SetMessageCallback(a.propertiesMessageHandler)
+	}
 	a.mqttClient = mqttClient
 	a.setPrefix(prefix)
 
@@ -114,66 +239,136 @@ func New(mqttClient MqttClient, prefix string) Agent {
 }
 
 func (a *agent) Connect() bool {
-	return a.mqttClient.Connect()
+	if !a.mqttClient.Connect() {
+		return false
+	}
+	a.started = time.Now()
+	a.publishStatus(StatusOnline)
+	return true
 }
 
 func (a *agent) Subscribe() bool {
-	return a.mqttClient.Subscribe(fmt.Sprintf("%sparam/+", a.prefix), byte(1)) &&
+	return a.mqttClient.Subscribe(fmt.Sprintf("%sparam/#", a.prefix), byte(1)) &&
 		a.mqttClient.Subscribe(fmt.Sprintf("%srule/+/+", a.prefix), byte(1)) &&
+		a.mqttClient.Subscribe(fmt.Sprintf("%srule/+/+/+", a.prefix), byte(1)) &&
+		a.mqttClient.Subscribe(fmt.Sprintf("%sscene/+", a.prefix), byte(1)) &&
 		a.mqttClient.Subscribe(fmt.Sprintf("%s$MQTTRULES", a.prefix), byte(1))
 }
 
 func (a *agent) Publish(topic string, qos byte, retained bool, payload string) {
+	a.publishWithProperties(topic, qos, retained, payload, nil)
+}
 
-	if success := a.mqttClient.Publish(topic, qos, retained, payload); !success {
+// publishWithProperties publishes a message including MQTT 5 properties. The properties are
+// dropped if the MQTT client does not support them.
+func (a *agent) publishWithProperties(topic string, qos byte, retained bool, payload string, properties *MessageProperties) {
+	var success bool
+	if pc, ok := a.mqttClient.(PropertiesClient); ok && properties != nil {
+		success = pc.PublishWithProperties(topic, qos, retained, payload, properties)
+	} else {
+		if properties != nil {
+			log.Debugf("MQTT client does not support message properties, sending [%s] without them", topic)
+		}
+		success = a.mqttClient.Publish(topic, qos, retained, payload)
+	}
+	if !success {
 		log.Errorf("Error publishing MQTT topic [%s]", topic)
 	}
 }
 
 func (a *agent) HandleMessage(topic string, payload []byte) {
-	_, exists := a.subscriptions[topic]
-	if exists {
-		a.handleIncomingTrigger(topic, string(payload))
+	a.handleMessage(message{topic: topic, payload: string(payload)})
+}
+
+func (a *agent) handleMessage(m message) {
+	topic := m.topic
+	payload := m.payload
+
+	for filter := range a.subscriptions {
+		if wildcards, matches := topicWildcards(filter, topic); matches {
+			m.wildcards = wildcards
+			a.handleIncomingTrigger(filter, m)
+		}
 	}
 
 	if res := a.regexParam.FindStringSubmatch(topic); res != nil {
-		a.SetParameterFromString(res[1], string(payload))
+		a.SetParameterFromString(parameterName(res[1]), payload)
 	}
 	if res := a.regexRule.FindStringSubmatch(topic); res != nil {
-		a.AddRuleFromString(res[1], res[2], string(payload))
+		// The format of the rule definition is given by the MQTT 5 content type, or else by an
+		// optional fourth topic level, e.g. rule/lights/kitchen_switch/yaml
+		format, ok := "", false
+		if m.properties != nil && len(m.properties.ContentType) > 0 {
+			format, ok = ParseFormat(m.properties.ContentType)
+		}
+		if !ok {
+			format, ok = ParseFormat(res[3])
+		}
+		if ok {
+			a.AddRuleFromFormattedString(res[1], res[2], format, payload)
+		} else {
+			log.Errorf("[Rule] Unknown rule format '%s'", res[3])
+		}
+	}
+	if res := a.regexScene.FindStringSubmatch(topic); res != nil {
+		a.activateSceneFromString(res[1], payload)
 	}
 	if a.regexSys.MatchString(topic) {
 		switch {
-		case strings.Compare("parameters", string(payload)) == 0:
-			for key := range a.parameters {
-				s, _ := json.Marshal(a.parameters[key])
-				a.Publish(fmt.Sprintf("%s$MQTTRULES/parameters/%s", a.prefix, key), 2, false, string(s))
+		case strings.Compare("parameters", payload) == 0:
+			a.publishParameters("")
+		case strings.HasPrefix(payload, "parameters "):
+			// Parameters of a group, e.g. "parameters kitchen.light"
+			a.publishParameters(parameterName(strings.TrimSpace(payload[len("parameters "):])))
+		case strings.Compare("scenes", payload) == 0:
+			a.Publish(fmt.Sprintf("%s$MQTTRULES/scenes", a.prefix), 2, false, strings.Join(a.sceneNames(), " "))
+		case strings.HasPrefix(payload, "scene "):
+			// Scene name, optionally followed by the parameters as JSON object
+			fields := strings.SplitN(strings.TrimSpace(payload[len("scene "):]), " ", 2)
+			if len(fields) == 1 {
+				fields = append(fields, "")
 			}
-		case strings.Compare("rules", string(payload)) == 0:
+			a.activateSceneFromString(fields[0], fields[1])
+		case strings.HasPrefix(payload, "deleteParameters "):
+			a.deleteParameters(parameterName(strings.TrimSpace(payload[len("deleteParameters "):])))
+		case strings.Compare("rules", payload) == 0:
 			for rk := range a.rules {
 				s, _ := json.Marshal(a.rules[rk])
 				a.Publish(fmt.Sprintf("%s$MQTTRULES/rules/%s/%s", a.prefix, rk.ruleset, rk.rule), 2, false, string(s))
 			}
 			a.Publish(fmt.Sprintf("%s$MQTTRULES/rules", a.prefix), 2, false, fmt.Sprintf("%+v", a.rules))
+		case strings.Compare("status", payload) == 0:
+			a.publishStatus(StatusOnline)
 		default:
-			a.Publish(fmt.Sprintf("%s$MQTTRULES", a.prefix), 2, false, fmt.Sprintf("Unknown command '%s'", string(payload)))
+			a.Publish(fmt.Sprintf("%s$MQTTRULES", a.prefix), 2, false, fmt.Sprintf("Unknown command '%s'", payload))
 		}
 	}
+	a.evaluateStateMachineConditions()
 }
 
 func (a *agent) Listen() {
-	incoming := <-a.messages
-	//log.Infof("Received [%s] %s\n", incoming[0], incoming[1])
-	a.HandleMessage(incoming[0], []byte(incoming[1]))
-
+	select {
+	case incoming := <-a.messages:
+		//log.Infof("Received [%s] %s\n", incoming[0], incoming[1])
+		a.HandleMessage(incoming[0], []byte(incoming[1]))
+	case m := <-a.incoming:
+		a.handleMessage(m)
+	}
 }
 
-func (a *agent) handleIncomingTrigger(topic string, payload string) {
-	for key := range a.subscriptions[topic].parameters {
-		a.TriggerParameterUpdate(key, payload)
+// handleIncomingTrigger updates the parameters and executes the rules subscribed to filter
+func (a *agent) handleIncomingTrigger(filter string, m message) {
+	for key := range a.subscriptions[filter].parameters {
+		a.triggerParameterUpdate(key, m)
+	}
+	for key := range a.subscriptions[filter].rules {
+		a.executeRule(key.ruleset, key.rule, m)
+	}
+	for name := range a.subscriptions[filter].machines {
+		a.handleStateMachineMessage(name, filter, m)
 	}
-	for key := range a.subscriptions[topic].rules {
-		a.ExecuteRule(key.ruleset, key.rule, payload)
+	for key := range a.subscriptions[filter].sequences {
+		a.handleSequenceEvent(key, filter, m)
 	}
 }
 
@@ -183,11 +378,16 @@ func (a *agent) ensureSubscription(topic string) bool {
 	}
 
 	if _, exists := a.subscriptions[topic]; !exists {
-		a.subscriptions[topic] = subscriptions{parameters: make(map[string]bool), rules: make(map[rulesKey]bool)}
+		a.subscriptions[topic] = subscriptions{
+			parameters: make(map[string]bool),
+			rules:      make(map[rulesKey]bool),
+			machines:   make(map[string]bool),
+			sequences:  make(map[rulesKey]bool),
+		}
 	}
-	if len(a.subscriptions[topic].parameters) == 0 && len(a.subscriptions[topic].rules) == 0 {
+	if a.subscriptions[topic].empty() && !isEventTopic(topic) {
 		if success := a.mqttClient.Subscribe(topic, byte(1)); !success {
-			log.Errorln("Failed to add subscription [%s]")
+			log.Errorf("Failed to add subscription [%s]", topic)
 			return false
 		}
 		log.Debugf("Subscribed to MQTT topic [%s]", topic)
@@ -200,10 +400,13 @@ func (a *agent) contemplateUnsubscription(topic string) bool {
 		return false
 	}
 
-	if len(a.subscriptions[topic].parameters) == 0 && len(a.subscriptions[topic].rules) == 0 {
+	if a.subscriptions[topic].empty() {
 		delete(a.subscriptions, topic)
+		if isEventTopic(topic) {
+			return true
+		}
 		if success := a.mqttClient.Unsubscribe(topic); !success {
-			log.Errorln("Failed to remove subscription [%s]")
+			log.Errorf("Failed to remove subscription [%s]", topic)
 			return false
 		}
 		log.Infof("Unsubscribed from MQTT topic [%s]", topic)
@@ -213,15 +416,19 @@ func (a *agent) contemplateUnsubscription(topic string) bool {
 
 func (a *agent) Disconnect() {
 	log.Infoln("Disconnecting from MQTT broker")
+	if a.mqttClient.IsConnected() {
+		a.publishStatus(StatusOffline)
+	}
 	a.mqttClient.Disconnect()
 }
 
 func (a *agent) setPrefix(prefix string) {
 	a.prefix = prefix
 
-	a.regexParam = regexp.MustCompile(fmt.Sprintf("^%sparam/([^/]+)", a.prefix))
-	a.regexRule = regexp.MustCompile(fmt.Sprintf("^%srule/([^/]+)/([^/]+)", a.prefix))
-	a.regexSys = regexp.MustCompile(fmt.Sprintf("^%s[$]MQTTRULES", a.prefix))
+	a.regexParam = regexp.MustCompile(fmt.Sprintf("^%sparam/(.+)$", a.prefix))
+	a.regexRule = regexp.MustCompile(fmt.Sprintf("^%srule/([^/]+)/([^/]+)(?:/([^/]+))?", a.prefix))
+	a.regexSys = regexp.MustCompile(fmt.Sprintf("^%s[$]MQTTRULES$", a.prefix))
+	a.regexScene = regexp.MustCompile(fmt.Sprintf("^%sscene/([^/]+)$", a.prefix))
 
 }
 
@@ -231,6 +438,16 @@ func (a *agent) IsSubscribed(topic string) bool {
 }
 
 func (a *agent) InjectConfigFile(c ConfigFile) {
+	if c.Config.ScriptTimeout > 0 {
+		a.scriptTimeout = time.Duration(c.Config.ScriptTimeout * float64(time.Second))
+	}
+	if c.Config.ScriptMemoryLimit > 0 {
+		a.scriptMemoryLimit = c.Config.ScriptMemoryLimit
+	}
+	a.paramMutex.Lock()
+	a.publishParameterValues = c.Config.PublishParameterValues
+	a.paramMutex.Unlock()
+
 	for n, p := range c.Parameters {
 		a.SetParameter(n, p)
 	}
@@ -240,4 +457,24 @@ func (a *agent) InjectConfigFile(c ConfigFile) {
 			a.AddRule(ruleset, rule, c.Rules[ruleset][rule])
 		}
 	}
+
+	for name, t := range c.Templates {
+		a.AddTemplate(name, t)
+	}
+	for _, i := range c.Instances {
+		a.AddInstance(i)
+	}
+
+	for name, s := range c.Scenes {
+		a.AddScene(name, s)
+	}
+
+	for name, m := range c.StateMachines {
+		a.AddStateMachine(name, m)
+	}
+
+	if a.mqttClient.IsConnected() {
+		// Update rule count
+		a.publishStatus(StatusOnline)
+	}
 }
@@ -1,7 +1,7 @@
 package agent
 
 import (
-	"encoding/json"
+	"fmt"
 	"io/ioutil"
 )
 
@@ -13,22 +13,68 @@ type Config struct {
 	Prefix             string
 	DisableRulesUpdate bool
 	Loglevel           string
+	QueueSize          int
+	// MQTT protocol version: 3 (MQTT 3.1), 4 (MQTT 3.1.1, default) or 5 (MQTT 5)
+	ProtocolVersion int
+
+	// TLS settings for ssl:// brokers; certificates and keys are given as paths to PEM files
+	CACert             string
+	ClientCert         string
+	ClientKey          string
+	ServerName         string
+	InsecureSkipVerify bool
+
+	// Limits per script execution: time in seconds and heap growth in MB. The memory limit is
+	// approximate, as it is checked periodically against the heap of the whole process.
+	ScriptTimeout     float64
+	ScriptMemoryLimit int
+
+	// Publish the values of all parameters to <prefix>value/<name> when they change
+	PublishParameterValues bool
 }
 
 type ConfigFile struct {
-	Config     Config
-	Parameters map[string]Parameter
-	Rules      map[string]map[string]Rule
+	Config        Config
+	Parameters    map[string]Parameter
+	Rules         map[string]map[string]Rule
+	StateMachines map[string]StateMachine
+	Scenes        map[string]Scene
+	Templates     map[string]RuleTemplate
+	Instances     []RuleInstance
+}
+
+// NewClientFromConfig creates the MQTT client for the protocol version given in c
+func NewClientFromConfig(c Config) (MqttClient, error) {
+	switch c.ProtocolVersion {
+	case 0, 3, 4:
+		return NewPahoClientFromConfig(c)
+	case 5:
+		return NewMqtt5ClientFromConfig(c)
+	}
+	return nil, fmt.Errorf("unsupported MQTT protocol version %d", c.ProtocolVersion)
 }
 
+// ConfigFromFile reads a configuration file. Files ending in .yaml/.yml or .toml are parsed
+// as YAML or TOML respectively, all other files as JSON. ${ENV:NAME} and ${FILE:path}
+// references in any string value are replaced (see ExpandSecrets).
 func ConfigFromFile(path string) (configFile *ConfigFile, e error) {
 	data, err := ioutil.ReadFile(path)
 
+	if err != nil {
+		return nil, err
+	}
+	doc, err := decodeDocument(data, formatFromPath(path))
+	if err != nil {
+		return nil, err
+	}
+	// Secrets are only expanded for the configuration file, never for rules or
+	// parameters received via MQTT, as these could be used to leak them.
+	doc, err = expandDocumentSecrets(doc)
 	if err != nil {
 		return nil, err
 	}
 	var c ConfigFile
-	err = json.Unmarshal(data, &c)
+	err = unmarshalDocument(doc, &c)
 	if err != nil {
 		return nil, err
 	}
@@ -2,7 +2,11 @@ package agent
 
 import (
 	"os"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/davecgh/go-spew/spew"
 )
 
 func TestConfigFromFile(t *testing.T) {
@@ -15,3 +19,51 @@ func TestConfigFromFile(t *testing.T) {
 	}
 
 }
+
+func TestConfigFromFile_Formats(t *testing.T) {
+	expected, err := ConfigFromFile("../test/testConfig.json")
+	if err != nil {
+		t.Fatalf("Failed to read JSON config file: %v", err)
+	}
+
+	for _, path := range []string{"../test/testConfig.yaml", "../test/testConfig.toml"} {
+		c, err := ConfigFromFile(path)
+		if err != nil {
+			t.Errorf("Failed to read config file %s: %v", path, err)
+			continue
+		}
+		if !reflect.DeepEqual(expected.Config, c.Config) {
+			t.Errorf("%s: config differs: %s", path, spew.Sdump(c.Config))
+		}
+		if !reflect.DeepEqual(expected.Parameters, c.Parameters) {
+			t.Errorf("%s: parameters differ: %s", path, spew.Sdump(c.Parameters))
+		}
+		if !reflect.DeepEqual(expected.Rules["lights"], c.Rules["lights"]) {
+			t.Errorf("%s: rules differ: %s", path, spew.Sdump(c.Rules["lights"]))
+		}
+		alive := c.Rules["general"]["alive"]
+		if len(alive.Actions) != 1 || !strings.HasSuffix(alive.Actions[0].Payload, "}\n") {
+			t.Errorf("%s: multi-line payload not read correctly: %s", path, spew.Sdump(alive))
+		}
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	for _, c := range []struct {
+		hint, format string
+		ok           bool
+	}{
+		{"", FormatJSON, true},
+		{".json", FormatJSON, true},
+		{"application/json", FormatJSON, true},
+		{".yml", FormatYAML, true},
+		{"YAML", FormatYAML, true},
+		{"application/x-yaml; charset=utf-8", FormatYAML, true},
+		{"toml", FormatTOML, true},
+		{"xml", "", false},
+	} {
+		if f, ok := ParseFormat(c.hint); f != c.format || ok != c.ok {
+			t.Errorf("ParseFormat(%q) == %q, %v, want %q, %v", c.hint, f, ok, c.format, c.ok)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package agent
+
+import (
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// isComputed returns true for parameters derived from other parameters: they have an
+// expression, but no topic
+func (p *Parameter) isComputed() bool {
+	return len(p.Expression) > 0 && len(p.Topic) == 0
+}
+
+// prepareComputedParameter determines the parameters that the expression of p refers to and
+// checks that they do not depend on the parameter name itself
+func (a *agent) prepareComputedParameter(name string, p *Parameter) error {
+	expression, err := newExpression(p.Expression, a.messageFunctions(message{}, ""))
+	if err != nil {
+		return err
+	}
+	p.dependencies = expression.Vars()
+
+	a.paramMutex.Lock()
+	defer a.paramMutex.Unlock()
+	if path := a.dependencyPath(p.dependencies, name, []string{name}); path != nil {
+		return fmt.Errorf("circular dependency %v", path)
+	}
+	return nil
+}
+
+// dependencyPath returns the chain of computed parameters leading from one of the
+// dependencies to target, or nil if there is none. paramMutex must be held.
+func (a *agent) dependencyPath(dependencies []string, target string, path []string) []string {
+	for _, d := range dependencies {
+		if d == target {
+			return append(path, d)
+		}
+		if p, exists := a.parameters[d]; exists && p.isComputed() {
+			if result := a.dependencyPath(p.dependencies, target, append(path, d)); result != nil {
+				return result
+			}
+		}
+	}
+	return nil
+}
+
+// updateDependents recomputes the computed parameters depending on parameter
+func (a *agent) updateDependents(parameter string) {
+	var dependents []string
+	a.paramMutex.Lock()
+	for name, p := range a.parameters {
+		if !p.isComputed() {
+			continue
+		}
+		for _, d := range p.dependencies {
+			if d == parameter {
+				dependents = append(dependents, name)
+				break
+			}
+		}
+	}
+	a.paramMutex.Unlock()
+
+	for _, name := range dependents {
+		a.computeParameter(name)
+	}
+}
+
+// computeParameter evaluates the expression of a computed parameter. It is skipped while not
+// all parameters it depends on have a value.
+func (a *agent) computeParameter(name string) {
+	a.paramMutex.Lock()
+	p, exists := a.parameters[name]
+	if exists {
+		for _, d := range p.dependencies {
+			if v := a.parameterValues[d]; v == nil {
+				exists = false
+				break
+			}
+		}
+	}
+	a.paramMutex.Unlock()
+	if !exists {
+		return
+	}
+
+	result, err := a.evaluateExpression(p.Expression, a.messageFunctions(message{}, fmt.Sprintf("computing parameter %s", name)))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"component": "Parameters",
+			"parameter": name,
+		}).Errorf("Error computing parameter: %v", err)
+		return
+	}
+	a.SetParameterValue(name, result)
+	log.WithFields(log.Fields{
+		"component": "Parameters",
+		"parameter": name,
+		"mode":      "computed",
+		"value":     result,
+	}).Debug("Parameter value updated")
+}
@@ -0,0 +1,48 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/crenz/mqttrules/test"
+)
+
+func TestAgent_ComputedParameters(t *testing.T) {
+	mqttClient := test.NewClient()
+	a := New(mqttClient, "")
+	mqttClient.SetSubscriptionCallback(nil)
+
+	// Defined before its inputs
+	a.SetParameterFromString("comfort", `{"expression": "temp_living - 0.5 * humidity_living"}`)
+	a.SetParameterFromString("comfortText", `{"expression": "comfort > 0 ? 'ok' : 'uncomfortable'"}`)
+	a.SetParameterFromString("temp_living", `{"value": 21, "topic": "sensors/living/temperature"}`)
+	if v := a.GetParameterValue("comfort"); v != nil {
+		t.Errorf("Computed parameter should not have a value before its inputs, got %v", v)
+	}
+
+	a.SetParameterFromString("humidity_living", `{"value": 40, "topic": "sensors/living/humidity", "expression": "payload()"}`)
+	if v := a.GetParameterValue("comfort"); v != 1.0 {
+		t.Errorf("comfort == %v, want 1", v)
+	}
+	if v := a.GetParameterValue("comfortText"); v != "ok" {
+		t.Errorf("comfortText == %v, want ok", v)
+	}
+
+	a.HandleMessage("sensors/living/humidity", []byte("50"))
+	if v := a.GetParameterValue("comfort"); v != -4.0 {
+		t.Errorf("comfort == %v, want -4", v)
+	}
+	if v := a.GetParameterValue("comfortText"); v != "uncomfortable" {
+		t.Errorf("comfortText == %v, want uncomfortable", v)
+	}
+
+	for name, expression := range map[string]string{
+		"self":        "self + 1",
+		"temp_living": "comfortText == 'ok' ? 20 : 22",
+		"invalid":     "1 +",
+	} {
+		a.SetParameter(name, Parameter{Expression: expression})
+		if p := a.(*agent).parameters[name]; p != nil && p.Expression == expression {
+			t.Errorf("Parameter %s with expression '%s' should be rejected", name, expression)
+		}
+	}
+}
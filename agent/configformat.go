@@ -0,0 +1,126 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Supported formats for configuration files and rule definitions
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+	FormatTOML = "toml"
+)
+
+// ParseFormat maps a format hint (file extension, topic suffix or content type such as
+// "application/x-yaml") onto one of the supported formats
+func ParseFormat(hint string) (string, bool) {
+	h := strings.ToLower(strings.TrimSpace(hint))
+	if i := strings.Index(h, ";"); i >= 0 {
+		h = strings.TrimSpace(h[:i])
+	}
+	if i := strings.LastIndexAny(h, "/."); i >= 0 {
+		h = h[i+1:]
+	}
+	h = strings.TrimPrefix(h, "x-")
+
+	switch h {
+	case "", "json":
+		return FormatJSON, true
+	case "yaml", "yml":
+		return FormatYAML, true
+	case "toml":
+		return FormatTOML, true
+	}
+	return "", false
+}
+
+func formatFromPath(path string) string {
+	if f, ok := ParseFormat(filepath.Ext(path)); ok {
+		return f
+	}
+	return FormatJSON
+}
+
+// unmarshalFormat decodes data in the given format into v. YAML and TOML documents are
+// converted to JSON first, so that all formats map onto the same structures with the
+// same (case-insensitive) field names.
+func unmarshalFormat(data []byte, format string, v interface{}) error {
+	if format == FormatJSON {
+		return json.Unmarshal(data, v)
+	}
+	doc, err := decodeDocument(data, format)
+	if err != nil {
+		return err
+	}
+	return unmarshalDocument(doc, v)
+}
+
+// decodeDocument decodes data in the given format into a generic document tree
+func decodeDocument(data []byte, format string) (interface{}, error) {
+	var doc interface{}
+
+	switch format {
+	case FormatJSON:
+		d := json.NewDecoder(bytes.NewReader(data))
+		d.UseNumber()
+		if err := d.Decode(&doc); err != nil {
+			return nil, err
+		}
+	case FormatYAML:
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+	case FormatTOML:
+		var m map[string]interface{}
+		if err := toml.Unmarshal(data, &m); err != nil {
+			return nil, err
+		}
+		doc = m
+	default:
+		return nil, fmt.Errorf("unsupported format '%s'", format)
+	}
+
+	if doc == nil {
+		return nil, fmt.Errorf("empty %s document", format)
+	}
+	return normalizeDocument(doc), nil
+}
+
+func unmarshalDocument(doc interface{}, v interface{}) error {
+	j, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(j, v)
+}
+
+// normalizeDocument converts maps with non-string keys (as produced by the YAML decoder)
+// into maps that can be serialized as JSON
+func normalizeDocument(in interface{}) interface{} {
+	switch v := in.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[fmt.Sprintf("%v", key)] = normalizeDocument(value)
+		}
+		return m
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = normalizeDocument(value)
+		}
+		return v
+	case []interface{}:
+		for i := range v {
+			v[i] = normalizeDocument(v[i])
+		}
+		return v
+	}
+	return in
+}
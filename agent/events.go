@@ -0,0 +1,55 @@
+package agent
+
+import (
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Events raised by the agent itself. Rules can react to them by using EventTopic(event) as
+// their trigger, e.g. "$MQTTRULES/event/connectionRestored".
+const (
+	EventConnectionLost     = "connectionLost"
+	EventConnectionRestored = "connectionRestored"
+)
+
+const eventTopicPrefix = "$MQTTRULES/event/"
+
+// EventTopic returns the trigger topic for an event raised by the agent. Event topics are
+// handled internally and never subscribed to at the broker.
+func EventTopic(event string) string {
+	return eventTopicPrefix + event
+}
+
+func isEventTopic(topic string) bool {
+	return strings.HasPrefix(topic, eventTopicPrefix)
+}
+
+// raiseEvent queues an event for processing by Listen. It must not be called from the
+// goroutine running Listen.
+func (a *agent) raiseEvent(event string, payload string) {
+	log.WithFields(log.Fields{
+		"component": "Events",
+		"event":     event,
+	}).Debug("Raising event")
+	a.messagehandler(EventTopic(event), payload)
+}
+
+func (a *agent) handleConnectionChange(connected bool) {
+	a.statusMutex.Lock()
+	wasLost := a.connectionLost
+	a.connectionLost = !connected
+	a.statusMutex.Unlock()
+
+	if !connected {
+		log.Warnln("Lost connection to MQTT broker")
+		a.raiseEvent(EventConnectionLost, "")
+		return
+	}
+	if wasLost {
+		log.Infoln("Connection to MQTT broker restored")
+		// The broker has published the last will in the meantime
+		a.publishStatus(StatusOnline)
+		a.raiseEvent(EventConnectionRestored, "")
+	}
+}
@@ -0,0 +1,44 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/crenz/mqttrules/test"
+	"github.com/davecgh/go-spew/spew"
+)
+
+func TestAgent_ConnectionEvents(t *testing.T) {
+	mqttClient := test.NewClient()
+	a := New(mqttClient, "")
+	// Do not loop back published messages
+	mqttClient.SetSubscriptionCallback(nil)
+
+	for _, event := range []string{EventConnectionLost, EventConnectionRestored} {
+		a.AddRuleFromString("connection", event, `{"trigger": "`+EventTopic(event)+`", "actions": [
+			{"topic": "connection/state", "payload": "`+event+`", "qos": 1}
+		]}`)
+		if !a.IsSubscribed(EventTopic(event)) || mqttClient.IsSubscribed(EventTopic(event)) {
+			t.Errorf("Event topic should be handled internally only")
+		}
+	}
+
+	a.Connect()
+	mqttClient.SimulateConnectionLoss()
+	a.Listen()
+	if m := mqttClient.LastMessage(); m.Topic != "connection/state" || m.Payload != EventConnectionLost {
+		t.Errorf("Rule not executed on connection loss")
+		spew.Dump(m)
+	}
+
+	mqttClient.Connect()
+	a.Listen()
+	if m := mqttClient.LastMessage(); m.Topic != "connection/state" || m.Payload != EventConnectionRestored {
+		t.Errorf("Rule not executed when connection was restored")
+		spew.Dump(m)
+	}
+
+	a.RemoveRuleSubscription(EventTopic(EventConnectionLost), "connection", EventConnectionLost)
+	if a.IsSubscribed(EventTopic(EventConnectionLost)) {
+		t.Errorf("Failed to remove event subscription")
+	}
+}
@@ -0,0 +1,136 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/Knetic/govaluate"
+	log "github.com/Sirupsen/logrus"
+	"github.com/oliveagle/jsonpath"
+)
+
+// registerMessageFunctions adds the built-in functions giving access to the message that
+// triggered a rule execution or parameter update
+func registerMessageFunctions(r *Registry) {
+	r.RegisterFunctionFactory("payload", func(a Agent, t Trigger) govaluate.ExpressionFunction {
+		return func(args ...interface{}) (interface{}, error) {
+			if len(args) == 0 {
+				// No JSON path given - return whole payload
+				return a.(*agent).parseParameterValue(t.Payload), nil
+			}
+			var jsonData interface{}
+			err := json.Unmarshal([]byte(t.Payload), &jsonData)
+			if err != nil {
+				log.Errorf("JSON parsing error in trigger payload when %s: %v", t.context, err)
+				return t.Payload, err
+			}
+			res, err := jsonpath.JsonPathLookup(jsonData, args[0].(string))
+			if err != nil {
+				log.Errorf("JSON lookup error in trigger payload when %s: %v", t.context, err)
+				return t.Payload, err
+			}
+
+			return res, nil
+		}
+	})
+
+	// get("name", path) looks up a JSON path in the value of a parameter holding a JSON object
+	// or array, get(value, path) in any JSON value
+	r.RegisterFunctionFactory("get", func(a Agent, t Trigger) govaluate.ExpressionFunction {
+		return func(args ...interface{}) (interface{}, error) {
+			if err := checkArgs("get", args, 2, 2); err != nil {
+				return nil, err
+			}
+			// A quoted parameter name has already been replaced by the parameter (see
+			// rewriteAccessors), so the first argument is always a value
+			value := args[0]
+			if s, isString := value.(string); isString {
+				if err := json.Unmarshal([]byte(s), &value); err != nil {
+					return nil, fmt.Errorf("get(): value is not JSON")
+				}
+			}
+			path, isString := args[1].(string)
+			if !isString {
+				return nil, fmt.Errorf("get(): JSON path must be a string")
+			}
+			res, err := jsonpath.JsonPathLookup(value, path)
+			if err != nil {
+				return nil, fmt.Errorf("get(): %v", err)
+			}
+			return res, nil
+		}
+	})
+
+	// topic() returns the trigger topic, topic(i) its level i (counting from 0)
+	r.RegisterFunctionFactory("topic", func(a Agent, t Trigger) govaluate.ExpressionFunction {
+		return func(args ...interface{}) (interface{}, error) {
+			if len(args) == 0 {
+				return t.Topic, nil
+			}
+			return topicLevel("topic", strings.Split(t.Topic, "/"), args)
+		}
+	})
+	// wildcard(i) returns the topic level matched by wildcard i of the trigger (counting from 0)
+	r.RegisterFunctionFactory("wildcard", func(a Agent, t Trigger) govaluate.ExpressionFunction {
+		return func(args ...interface{}) (interface{}, error) {
+			return topicLevel("wildcard", t.Wildcards, args)
+		}
+	})
+
+	property := func(get func(p *MessageProperties) interface{}) FunctionFactory {
+		return func(a Agent, t Trigger) govaluate.ExpressionFunction {
+			properties := t.Properties
+			if properties == nil {
+				properties = &MessageProperties{}
+			}
+			return func(args ...interface{}) (interface{}, error) {
+				return get(properties), nil
+			}
+		}
+	}
+	r.RegisterFunctionFactory("contentType", property(func(p *MessageProperties) interface{} {
+		return p.ContentType
+	}))
+	r.RegisterFunctionFactory("responseTopic", property(func(p *MessageProperties) interface{} {
+		return p.ResponseTopic
+	}))
+	r.RegisterFunctionFactory("correlationData", property(func(p *MessageProperties) interface{} {
+		return p.CorrelationData
+	}))
+	r.RegisterFunctionFactory("messageExpiry", property(func(p *MessageProperties) interface{} {
+		return float64(p.MessageExpiry)
+	}))
+	r.RegisterFunctionFactory("userProperty", func(a Agent, t Trigger) govaluate.ExpressionFunction {
+		return func(args ...interface{}) (interface{}, error) {
+			if len(args) != 1 {
+				return nil, fmt.Errorf("userProperty() expects the property name as argument")
+			}
+			if t.Properties == nil {
+				return "", nil
+			}
+			return t.Properties.UserProperties[fmt.Sprintf("%v", args[0])], nil
+		}
+	})
+}
+
+func topicLevel(name string, levels []string, args []interface{}) (interface{}, error) {
+	if err := checkArgs(name, args, 1, 1); err != nil {
+		return nil, err
+	}
+	i, err := number(name, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if i < 0 || int(i) >= len(levels) {
+		return nil, fmt.Errorf("%s(): index %v out of range", name, args[0])
+	}
+	return levels[int(i)], nil
+}
+
+// messageFunctions returns the expression functions for a rule execution or parameter update
+// triggered by m. context describes the operation for error messages, e.g. "executing rule
+// lights/kitchen".
+func (a *agent) messageFunctions(m message, context string) map[string]govaluate.ExpressionFunction {
+	return a.registry.expressionFunctions(a, m.trigger(context))
+}
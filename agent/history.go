@@ -0,0 +1,234 @@
+package agent
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/Knetic/govaluate"
+)
+
+// maxHistorySize limits the number of values kept for parameters with a time-bounded history
+const maxHistorySize = 10000
+
+// sample is a parameter value recorded at a point in time
+type sample struct {
+	time  time.Time
+	value interface{}
+}
+
+// history is a ring buffer of the most recent values of a parameter, bounded by the number of
+// values and optionally by their age
+type history struct {
+	samples []sample
+	start   int
+	count   int
+	maxAge  time.Duration
+}
+
+func newHistory(size int, maxAge time.Duration) *history {
+	if size <= 0 || size > maxHistorySize {
+		size = maxHistorySize
+	}
+	return &history{samples: make([]sample, size), maxAge: maxAge}
+}
+
+// newParameterHistory creates the history configured for p, or nil if p keeps no history
+func newParameterHistory(p Parameter) *history {
+	if p.HistorySize <= 0 && p.HistoryAge <= 0 {
+		return nil
+	}
+	return newHistory(p.HistorySize, time.Duration(p.HistoryAge*float64(time.Second)))
+}
+
+func (h *history) add(t time.Time, value interface{}) {
+	i := (h.start + h.count) % len(h.samples)
+	h.samples[i] = sample{t, value}
+	if h.count < len(h.samples) {
+		h.count++
+	} else {
+		h.start = (h.start + 1) % len(h.samples)
+	}
+	h.expire(t)
+}
+
+// expire drops values older than maxAge
+func (h *history) expire(now time.Time) {
+	if h.maxAge <= 0 {
+		return
+	}
+	for h.count > 0 && now.Sub(h.samples[h.start].time) > h.maxAge {
+		h.samples[h.start] = sample{}
+		h.start = (h.start + 1) % len(h.samples)
+		h.count--
+	}
+}
+
+// since returns the values recorded at or after t, oldest first
+func (h *history) since(t time.Time) []sample {
+	var result []sample
+	for i := 0; i < h.count; i++ {
+		s := h.samples[(h.start+i)%len(h.samples)]
+		if !s.time.Before(t) {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// historyAggregates are the expression functions aggregating the history of a parameter, e.g.
+// avg("temperature", "5m"). They are called with the name of the parameter and an optional
+// time window given as duration string or number of seconds; without a window, all recorded
+// values are used.
+var historyAggregates = map[string]func(name string, samples []sample) (interface{}, error){
+	"avg": func(name string, samples []sample) (interface{}, error) {
+		values, err := sampleValues(name, samples)
+		if err != nil {
+			return nil, err
+		}
+		sum := 0.0
+		for _, v := range values {
+			sum += v
+		}
+		return sum / float64(len(values)), nil
+	},
+	"min": func(name string, samples []sample) (interface{}, error) {
+		values, err := sampleValues(name, samples)
+		if err != nil {
+			return nil, err
+		}
+		result := math.Inf(1)
+		for _, v := range values {
+			result = math.Min(result, v)
+		}
+		return result, nil
+	},
+	"max": func(name string, samples []sample) (interface{}, error) {
+		values, err := sampleValues(name, samples)
+		if err != nil {
+			return nil, err
+		}
+		result := math.Inf(-1)
+		for _, v := range values {
+			result = math.Max(result, v)
+		}
+		return result, nil
+	},
+	// delta is the difference between the newest and the oldest value in the window
+	"delta": func(name string, samples []sample) (interface{}, error) {
+		values, err := sampleValues(name, samples)
+		if err != nil {
+			return nil, err
+		}
+		return values[len(values)-1] - values[0], nil
+	},
+	// rate is the change per second between the oldest and the newest value in the window
+	"rate": func(name string, samples []sample) (interface{}, error) {
+		values, err := sampleValues(name, samples)
+		if err != nil {
+			return nil, err
+		}
+		seconds := samples[len(samples)-1].time.Sub(samples[0].time).Seconds()
+		if seconds <= 0 {
+			return 0.0, nil
+		}
+		return (values[len(values)-1] - values[0]) / seconds, nil
+	},
+	"count": func(name string, samples []sample) (interface{}, error) {
+		return float64(len(samples)), nil
+	},
+}
+
+func sampleValues(name string, samples []sample) ([]float64, error) {
+	if len(samples) == 0 {
+		return nil, fmt.Errorf("%s(): no values in time window", name)
+	}
+	values := make([]float64, len(samples))
+	for i, s := range samples {
+		v, err := number(name, s.value)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+// registerHistoryFunctions adds the history aggregates. min() and max() keep their standard
+// behaviour unless called with the name of a parameter keeping a history.
+func registerHistoryFunctions(r *Registry) {
+	for name, aggregate := range historyAggregates {
+		name, aggregate := name, aggregate
+		standard := standardFunctions[name]
+		r.RegisterFunctionFactory(name, func(ag Agent, t Trigger) govaluate.ExpressionFunction {
+			a := ag.(*agent)
+			return func(args ...interface{}) (interface{}, error) {
+				parameter, isString := firstArg(args).(string)
+				if standard != nil && (!isString || !a.hasHistory(parameter)) {
+					return standard(args...)
+				}
+				if err := checkArgs(name, args, 1, 2); err != nil {
+					return nil, err
+				}
+				if !isString {
+					return nil, fmt.Errorf("%s(): expects the name of a parameter", name)
+				}
+				var window interface{}
+				if len(args) > 1 {
+					window = args[1]
+				}
+				samples, err := a.parameterHistory(name, parameter, window)
+				if err != nil {
+					return nil, err
+				}
+				return aggregate(name, samples)
+			}
+		})
+	}
+}
+
+func firstArg(args []interface{}) interface{} {
+	if len(args) == 0 {
+		return nil
+	}
+	return args[0]
+}
+
+func (a *agent) hasHistory(parameter string) bool {
+	a.paramMutex.Lock()
+	defer a.paramMutex.Unlock()
+	_, exists := a.histories[parameter]
+	return exists
+}
+
+// parameterHistory returns the values of a parameter recorded within window, a duration string
+// like "5m" or a number of seconds. A nil window returns all recorded values.
+func (a *agent) parameterHistory(name string, parameter string, window interface{}) ([]sample, error) {
+	var since time.Time
+	if window != nil {
+		var d time.Duration
+		if s, isString := window.(string); isString {
+			var err error
+			if d, err = time.ParseDuration(strings.TrimSpace(s)); err != nil {
+				return nil, fmt.Errorf("%s(): invalid time window '%s'", name, s)
+			}
+		} else {
+			seconds, err := number(name, window)
+			if err != nil {
+				return nil, err
+			}
+			d = time.Duration(seconds * float64(time.Second))
+		}
+		since = time.Now().Add(-d)
+	}
+
+	a.paramMutex.Lock()
+	defer a.paramMutex.Unlock()
+	h, exists := a.histories[parameter]
+	if !exists {
+		return nil, fmt.Errorf("%s(): parameter '%s' does not keep a history", name, parameter)
+	}
+	h.expire(time.Now())
+	return h.since(since), nil
+}
@@ -0,0 +1,100 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/crenz/mqttrules/test"
+	"github.com/davecgh/go-spew/spew"
+)
+
+func TestHistory(t *testing.T) {
+	h := newHistory(3, 0)
+	now := time.Now()
+	for i := 1; i <= 4; i++ {
+		h.add(now.Add(time.Duration(i)*time.Second), float64(i))
+	}
+	samples := h.since(time.Time{})
+	if len(samples) != 3 || samples[0].value != 2.0 || samples[2].value != 4.0 {
+		t.Error("Unexpected values in count-bounded history")
+		spew.Dump(samples)
+	}
+	if samples := h.since(now.Add(3 * time.Second)); len(samples) != 2 {
+		t.Errorf("Expected 2 values since t+3s, got %d", len(samples))
+	}
+
+	h = newHistory(0, time.Minute)
+	h.add(now.Add(-2*time.Minute), 1.0)
+	h.add(now.Add(-30*time.Second), 2.0)
+	h.add(now, 3.0)
+	if samples := h.since(time.Time{}); len(samples) != 2 || samples[0].value != 2.0 {
+		t.Error("Unexpected values in time-bounded history")
+		spew.Dump(samples)
+	}
+}
+
+func TestAgent_HistoryAggregates(t *testing.T) {
+	mqttClient := test.NewClient()
+	a := New(mqttClient, "").(*agent)
+	mqttClient.SetSubscriptionCallback(nil)
+
+	a.SetParameterFromString("temperature", `{"value": 20, "topic": "sensors/temperature", "historySize": 10}`)
+	// Record earlier values with known times
+	now := time.Now()
+	h := a.histories["temperature"]
+	*h = *newHistory(10, 0)
+	for i, v := range []float64{18, 19, 17, 21, 24} {
+		h.add(now.Add(time.Duration(i-5)*time.Minute), v)
+	}
+
+	var tests = []struct {
+		expression string
+		expected   interface{}
+	}{
+		{`avg("temperature")`, 19.8},
+		{`min("temperature")`, 17.0},
+		{`max("temperature", "10m")`, 24.0},
+		{`count("temperature", "150s")`, 2.0},
+		{`count("temperature", 150)`, 2.0},
+		{`delta("temperature", "3m30s")`, 7.0},
+		{`rate("temperature", "3m30s") * 60`, 3.5},
+		{`min(3, 1, 2)`, 1.0},
+		{`max("4", 3)`, 4.0},
+	}
+	functions := a.messageFunctions(message{}, "")
+	for _, test := range tests {
+		result, err := a.evaluateExpression(test.expression, functions)
+		if err != nil || result != test.expected {
+			t.Errorf("%s == %v (%v), want %v", test.expression, result, err, test.expected)
+		}
+	}
+
+	for _, expression := range []string{`avg("humidity")`, `avg("temperature", "5x")`, `avg("temperature", "1ms")`} {
+		if _, err := a.evaluateExpression(expression, functions); err == nil {
+			t.Errorf("Expected error for %s", expression)
+		}
+	}
+
+	a.AddRuleFromString("heating", "rising", `{
+		"trigger": "sensors/temperature",
+		"condition": "delta(\"temperature\", \"10m\") >= 3",
+		"actions": [{"topic": "alerts/temperature", "payload": "rising ${count(\"temperature\")}"}]
+	}`)
+	a.HandleMessage("sensors/temperature", []byte("25"))
+	if m := mqttClient.LastMessage(); m.Topic != "alerts/temperature" || m.Payload != "rising 6" {
+		t.Error("Unexpected message for rule using history")
+		spew.Dump(m)
+	}
+}
+
+func TestAgent_HistoryWithoutInitialValue(t *testing.T) {
+	mqttClient := test.NewClient()
+	a := New(mqttClient, "").(*agent)
+	mqttClient.SetSubscriptionCallback(nil)
+
+	a.SetParameter("h", Parameter{Topic: "s/h", HistorySize: 3})
+	a.HandleMessage("s/h", []byte("10"))
+	if v, err := a.evaluateExpression(`avg("h")`, a.messageFunctions(message{}, "")); err != nil || v != 10.0 {
+		t.Errorf("Expected average 10 ignoring the missing initial value, got %v (%v)", v, err)
+	}
+}
@@ -0,0 +1,61 @@
+package agent
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/crenz/mqttrules/test"
+	"github.com/davecgh/go-spew/spew"
+)
+
+func TestAgent_JSONParameters(t *testing.T) {
+	mqttClient := test.NewClient()
+	a := New(mqttClient, "")
+	mqttClient.SetSubscriptionCallback(nil)
+
+	a.SetParameterFromString("lamp", `{"topic": "lights/lamp/status", "expression": "payload(\"$.state\")"}`)
+	a.SetParameterFromString("raw", `{"topic": "lights/lamp/status"}`)
+	a.SetParameterFromString("list", `[1, 2, 3]`)
+	a.SetParameterFromString("state", `{"on": true, "brightness": 10}`)
+	a.SetParameterFromString("text", `{"value": "{\"on\": true}", "type": "string"}`)
+	a.SetParameterFromString("mode", "lamp")
+	a.HandleMessage("lights/lamp/status", []byte(`{"state": {"on": true, "brightness": 80, "color": {"hue": 120}}}`))
+
+	expected := map[string]interface{}{"on": true, "brightness": 80.0, "color": map[string]interface{}{"hue": 120.0}}
+	if v := a.GetParameterValue("lamp"); !reflect.DeepEqual(v, expected) {
+		t.Error("Unexpected value of JSON parameter")
+		spew.Dump(v)
+	}
+
+	var tests = []struct {
+		expression string
+		expected   interface{}
+	}{
+		{`get("lamp", "$.on")`, true},
+		{`get("lamp", "$.color.hue") + 1`, 121.0},
+		{`get(lamp, "$.brightness")`, 80.0},
+		{`get("raw", "$.state.brightness") > 50`, true},
+		{`get("list", "$[1]")`, 2.0},
+		{`get("state", "$.brightness")`, 10.0},
+		{`get(text, "$.on")`, true},
+	}
+	functions := a.(*agent).messageFunctions(message{}, "")
+	for _, test := range tests {
+		result, err := a.(*agent).evaluateExpression(test.expression, functions)
+		if err != nil || result != test.expected {
+			t.Errorf("%s == %v (%v), want %v", test.expression, result, err, test.expected)
+		}
+	}
+	for _, expression := range []string{`get("missing", "$.on")`, `get("lamp", "$.missing")`, `get("lamp")`, `get(mode, "$.on")`} {
+		if _, err := a.(*agent).evaluateExpression(expression, functions); err == nil {
+			t.Errorf("Expected error for %s", expression)
+		}
+	}
+
+	a.AddRuleFromString("lights", "color", `{"actions": [{"topic": "lights/lamp/color", "payload": "${get(\"lamp\", \"$.color\")}"}]}`)
+	a.ExecuteRule("lights", "color", "")
+	if m := mqttClient.LastMessage(); m.Payload != `{"hue":120}` {
+		t.Error("JSON object should be interpolated as JSON")
+		spew.Dump(m)
+	}
+}
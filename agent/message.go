@@ -0,0 +1,37 @@
+package agent
+
+// MessageProperties holds the MQTT 5 properties of a message. They are only transmitted if the
+// MQTT 5 client is used (protocolVersion 5 in the configuration).
+type MessageProperties struct {
+	ContentType     string
+	ResponseTopic   string
+	CorrelationData string
+	UserProperties  map[string]string
+	// Message expiry interval in seconds; 0 means the message does not expire
+	MessageExpiry uint32
+}
+
+// PropertiesClient is implemented by MQTT clients supporting MQTT 5 message properties
+type PropertiesClient interface {
+	SetMessageCallback(callback func(topic string, payload string, properties *MessageProperties))
+	PublishWithProperties(topic string, qos byte, retained bool, payload interface{}, properties *MessageProperties) bool
+}
+
+// message is an incoming MQTT message or internal event
+type message struct {
+	topic      string
+	payload    string
+	properties *MessageProperties
+	// Topic levels matched by the wildcards of the subscription filter
+	wildcards []string
+	// Messages matched by a sequence trigger
+	events []message
+}
+
+func (m message) trigger(context string) Trigger {
+	t := Trigger{Topic: m.topic, Payload: m.payload, Properties: m.properties, Wildcards: m.wildcards, context: context}
+	for _, e := range m.events {
+		t.Events = append(t.Events, e.trigger(context))
+	}
+	return t
+}
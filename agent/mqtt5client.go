@@ -0,0 +1,808 @@
+package agent
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Number of topic aliases the broker may use when sending messages to the client
+const mqtt5InboundTopicAliases = 32
+
+var errNotConnected = errors.New("not connected")
+
+// Mqtt5Client is an MQTT client implementing protocol version 5, including message properties
+// and topic aliases
+type Mqtt5Client interface {
+	IsConnected() bool
+	Connect() bool
+	Disconnect()
+	SetSubscriptionCallback(callback func(string, string))
+	SetConnectionCallback(callback func(bool))
+	Publish(topic string, qos byte, retained bool, payload interface{}) bool
+	Subscribe(topic string, qos byte) bool
+	Unsubscribe(topics ...string) bool
+
+	SetMessageCallback(callback func(topic string, payload string, properties *MessageProperties))
+	PublishWithProperties(topic string, qos byte, retained bool, payload interface{}, properties *MessageProperties) bool
+}
+
+// Mqtt5Options configures an MQTT 5 client
+type Mqtt5Options struct {
+	Broker    string
+	ClientID  string
+	Username  string
+	Password  string
+	TLSConfig *tls.Config
+	KeepAlive time.Duration
+	QueueSize int
+
+	WillTopic   string
+	WillPayload string
+	WillQoS     byte
+	WillRetain  bool
+}
+
+type mqtt5Client struct {
+	options Mqtt5Options
+
+	mutex          sync.Mutex
+	conn           net.Conn
+	online         bool
+	closed         bool
+	subscriptions  map[string]byte
+	pending        map[uint16]chan packet
+	nextID         uint16
+	topicAliasMax  uint16
+	topicAliases   map[string]uint16
+	inboundAliases map[uint16]string
+	inboundQoS2    map[uint16]bool
+	queue          *publishQueue
+	writeMutex     sync.Mutex
+
+	dispatchMutex sync.Mutex
+	dispatchCond  *sync.Cond
+	dispatchQueue []message
+
+	subscriptionCallback func(string, string)
+	messageCallback      func(string, string, *MessageProperties)
+	connectionCallback   func(bool)
+
+	connectTimeout       time.Duration
+	reconnectInterval    time.Duration
+	maxReconnectInterval time.Duration
+}
+
+// NewMqtt5Client creates an MQTT 5 client. Like the Paho client, it reconnects automatically
+// and queues messages with QoS > 0 while the connection to the broker is down.
+func NewMqtt5Client(o Mqtt5Options) Mqtt5Client {
+	if o.KeepAlive == 0 {
+		o.KeepAlive = 30 * time.Second
+	}
+	c := &mqtt5Client{
+		options:              o,
+		subscriptions:        make(map[string]byte),
+		pending:              make(map[uint16]chan packet),
+		queue:                newPublishQueue(o.QueueSize),
+		closed:               true,
+		connectTimeout:       30 * time.Second,
+		reconnectInterval:    time.Second,
+		maxReconnectInterval: 2 * time.Minute,
+	}
+	c.dispatchCond = sync.NewCond(&c.dispatchMutex)
+	go c.dispatch()
+	return c
+}
+
+// NewMqtt5ClientFromConfig creates an MQTT 5 client using the broker, credentials and TLS
+// settings in c
+func NewMqtt5ClientFromConfig(c Config) (Mqtt5Client, error) {
+	tlsConfig, err := NewTLSConfig(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewMqtt5Client(Mqtt5Options{
+		Broker:      c.Broker,
+		ClientID:    c.ClientID,
+		Username:    c.Username,
+		Password:    c.Password,
+		TLSConfig:   tlsConfig,
+		QueueSize:   c.QueueSize,
+		WillTopic:   StatusTopic(c.Prefix),
+		WillPayload: StatusOffline,
+		WillQoS:     1,
+		WillRetain:  true,
+	}), nil
+}
+
+func (c *mqtt5Client) IsConnected() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.conn != nil
+}
+
+func (c *mqtt5Client) SetSubscriptionCallback(callback func(string, string)) {
+	c.subscriptionCallback = callback
+}
+
+// SetMessageCallback sets a function receiving incoming messages including their properties.
+// If set, it is used instead of the subscription callback.
+func (c *mqtt5Client) SetMessageCallback(callback func(string, string, *MessageProperties)) {
+	c.messageCallback = callback
+}
+
+func (c *mqtt5Client) SetConnectionCallback(callback func(bool)) {
+	c.connectionCallback = callback
+}
+
+func (c *mqtt5Client) Connect() bool {
+	c.mutex.Lock()
+	c.closed = false
+	c.mutex.Unlock()
+
+	if err := c.connect(); err != nil {
+		log.Errorf("[Mqtt5Client] Error connecting to MQTT broker: %v", err)
+		c.mutex.Lock()
+		c.closed = true
+		c.mutex.Unlock()
+		return false
+	}
+	log.WithFields(log.Fields{
+		"component": "Mqtt5Client",
+	}).Debug("Connected to MQTT broker successfully")
+	return true
+}
+
+func (c *mqtt5Client) Disconnect() {
+	c.mutex.Lock()
+	c.closed = true
+	c.online = false
+	conn := c.conn
+	c.conn = nil
+	c.mutex.Unlock()
+
+	if conn != nil {
+		c.writeTo(conn, packet{packetDisconnect << 4, nil})
+		conn.Close()
+	}
+}
+
+func (c *mqtt5Client) dial() (net.Conn, error) {
+	u, err := url.Parse(c.options.Broker)
+	if err != nil {
+		return nil, err
+	}
+	d := &net.Dialer{Timeout: c.connectTimeout}
+
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		return d.Dial("tcp", hostWithPort(u, "1883"))
+	case "ssl", "tls", "mqtts":
+		return tls.DialWithDialer(d, "tcp", hostWithPort(u, "8883"), c.options.TLSConfig)
+	}
+	return nil, fmt.Errorf("unsupported broker URI scheme '%s'", u.Scheme)
+}
+
+func hostWithPort(u *url.URL, defaultPort string) string {
+	if len(u.Port()) > 0 {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), defaultPort)
+}
+
+func (c *mqtt5Client) connectPacket() packet {
+	o := c.options
+	var w packetWriter
+
+	w.string("MQTT")
+	w.WriteByte(5)
+	flags := byte(0x02) // clean start
+	if len(o.WillTopic) > 0 {
+		flags |= 0x04 | o.WillQoS<<3
+		if o.WillRetain {
+			flags |= 0x20
+		}
+	}
+	if len(o.Username) > 0 {
+		flags |= 0x80
+	}
+	if len(o.Password) > 0 {
+		flags |= 0x40
+	}
+	w.WriteByte(flags)
+	w.uint16(uint16(o.KeepAlive / time.Second))
+	w.properties(&packetProperties{topicAliasMaximum: mqtt5InboundTopicAliases})
+
+	w.string(o.ClientID)
+	if len(o.WillTopic) > 0 {
+		w.properties(nil)
+		w.string(o.WillTopic)
+		w.string(o.WillPayload)
+	}
+	if len(o.Username) > 0 {
+		w.string(o.Username)
+	}
+	if len(o.Password) > 0 {
+		w.string(o.Password)
+	}
+	return w.packet(packetConnect << 4)
+}
+
+// connect establishes the connection, restores subscriptions and publishes queued messages
+func (c *mqtt5Client) connect() error {
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(c.connectTimeout))
+	if err := writePacket(conn, c.connectPacket()); err != nil {
+		conn.Close()
+		return err
+	}
+	in := bufio.NewReader(conn)
+	p, err := readPacket(in)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if p.kind() != packetConnack {
+		conn.Close()
+		return fmt.Errorf("expected CONNACK, received packet type %d", p.kind())
+	}
+	r := packetReader{data: p.body}
+	r.byte()
+	reason := r.byte()
+	properties := r.properties()
+	if r.err != nil {
+		conn.Close()
+		return r.err
+	}
+	if reason >= 0x80 {
+		conn.Close()
+		return fmt.Errorf("connection refused with reason code 0x%02x %s", reason, properties.reasonString)
+	}
+	conn.SetDeadline(time.Time{})
+
+	keepAlive := c.options.KeepAlive
+	if properties.serverKeepAlive > 0 {
+		keepAlive = time.Duration(properties.serverKeepAlive) * time.Second
+	}
+
+	c.mutex.Lock()
+	c.conn = conn
+	c.topicAliasMax = properties.topicAliasMaximum
+	c.topicAliases = make(map[string]uint16)
+	c.inboundAliases = make(map[uint16]string)
+	c.inboundQoS2 = make(map[uint16]bool)
+	c.mutex.Unlock()
+
+	done := make(chan struct{})
+	go c.readLoop(conn, in, keepAlive, done)
+	go c.pingLoop(conn, keepAlive, done)
+
+	c.resubscribe()
+	c.mutex.Lock()
+	c.online = true
+	messages := c.queue.take()
+	c.mutex.Unlock()
+	c.replay(messages)
+
+	if c.connectionCallback != nil {
+		c.connectionCallback(true)
+	}
+	return nil
+}
+
+func (c *mqtt5Client) readLoop(conn net.Conn, in *bufio.Reader, keepAlive time.Duration, done chan struct{}) {
+	defer close(done)
+	for {
+		if keepAlive > 0 {
+			conn.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+		}
+		p, err := readPacket(in)
+		if err != nil {
+			c.connectionLost(conn, err)
+			return
+		}
+		if err := c.handlePacket(conn, p); err != nil {
+			c.connectionLost(conn, err)
+			return
+		}
+	}
+}
+
+func (c *mqtt5Client) pingLoop(conn net.Conn, keepAlive time.Duration, done chan struct{}) {
+	if keepAlive == 0 {
+		return
+	}
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			c.writeTo(conn, packet{packetPingreq << 4, nil})
+		}
+	}
+}
+
+func (c *mqtt5Client) connectionLost(conn net.Conn, err error) {
+	c.mutex.Lock()
+	if c.conn != conn {
+		// Disconnected on purpose
+		c.mutex.Unlock()
+		return
+	}
+	c.conn = nil
+	c.online = false
+	pending := c.pending
+	c.pending = make(map[uint16]chan packet)
+	c.mutex.Unlock()
+
+	conn.Close()
+	for _, ch := range pending {
+		close(ch)
+	}
+	log.WithFields(log.Fields{
+		"component": "Mqtt5Client",
+	}).Debugf("Lost connection to broker: %v", err)
+	if c.connectionCallback != nil {
+		c.connectionCallback(false)
+	}
+	go c.reconnect()
+}
+
+func (c *mqtt5Client) reconnect() {
+	interval := c.reconnectInterval
+	for {
+		time.Sleep(interval)
+		c.mutex.Lock()
+		closed := c.closed
+		c.mutex.Unlock()
+		if closed {
+			return
+		}
+		err := c.connect()
+		if err == nil {
+			return
+		}
+		log.WithFields(log.Fields{
+			"component": "Mqtt5Client",
+		}).Debugf("Reconnecting failed: %v", err)
+		if interval *= 2; interval > c.maxReconnectInterval {
+			interval = c.maxReconnectInterval
+		}
+	}
+}
+
+func (c *mqtt5Client) handlePacket(conn net.Conn, p packet) error {
+	r := packetReader{data: p.body}
+
+	switch p.kind() {
+	case packetPublish:
+		qos := (p.header >> 1) & 0x03
+		topic := r.string()
+		var id uint16
+		if qos > 0 {
+			id = r.uint16()
+		}
+		properties := r.properties()
+		payload := r.remaining()
+		if r.err != nil {
+			return r.err
+		}
+
+		c.mutex.Lock()
+		if properties.topicAlias > 0 {
+			if len(topic) > 0 {
+				c.inboundAliases[properties.topicAlias] = topic
+			} else {
+				topic = c.inboundAliases[properties.topicAlias]
+			}
+		}
+		duplicate := qos == 2 && c.inboundQoS2[id]
+		if qos == 2 {
+			c.inboundQoS2[id] = true
+		}
+		c.mutex.Unlock()
+
+		switch qos {
+		case 1:
+			c.writeTo(conn, ackPacket(packetPuback<<4, id))
+		case 2:
+			c.writeTo(conn, ackPacket(packetPubrec<<4, id))
+		}
+		if !duplicate && len(topic) > 0 {
+			c.enqueueMessage(message{topic: topic, payload: string(payload), properties: properties.messageProperties()})
+		}
+	case packetPubrel:
+		id := r.uint16()
+		c.mutex.Lock()
+		delete(c.inboundQoS2, id)
+		c.mutex.Unlock()
+		c.writeTo(conn, ackPacket(packetPubcomp<<4, id))
+	case packetPuback, packetPubrec, packetPubcomp, packetSuback, packetUnsuback:
+		id := r.uint16()
+		c.mutex.Lock()
+		ch, exists := c.pending[id]
+		c.mutex.Unlock()
+		if exists {
+			select {
+			case ch <- p:
+			default:
+				// Ignore duplicate acknowledgements
+			}
+		}
+	case packetDisconnect:
+		reason := r.byte()
+		return fmt.Errorf("disconnected by broker with reason code 0x%02x", reason)
+	}
+	return nil
+}
+
+func ackPacket(header byte, id uint16) packet {
+	var w packetWriter
+	w.uint16(id)
+	return w.packet(header)
+}
+
+func (c *mqtt5Client) enqueueMessage(m message) {
+	c.dispatchMutex.Lock()
+	c.dispatchQueue = append(c.dispatchQueue, m)
+	c.dispatchMutex.Unlock()
+	c.dispatchCond.Signal()
+}
+
+// dispatch delivers incoming messages to the callbacks. It runs in a goroutine of its own, so
+// that acknowledgements can still be received while a callback publishes messages.
+func (c *mqtt5Client) dispatch() {
+	for {
+		c.dispatchMutex.Lock()
+		for len(c.dispatchQueue) == 0 {
+			c.dispatchCond.Wait()
+		}
+		m := c.dispatchQueue[0]
+		c.dispatchQueue = c.dispatchQueue[1:]
+		c.dispatchMutex.Unlock()
+
+		if c.messageCallback != nil {
+			c.messageCallback(m.topic, m.payload, m.properties)
+		} else if c.subscriptionCallback != nil {
+			c.subscriptionCallback(m.topic, m.payload)
+		}
+	}
+}
+
+func (c *mqtt5Client) write(p packet) error {
+	c.mutex.Lock()
+	conn := c.conn
+	c.mutex.Unlock()
+	if conn == nil {
+		return errNotConnected
+	}
+	return c.writeTo(conn, p)
+}
+
+func (c *mqtt5Client) writeTo(conn net.Conn, p packet) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return writeWithDeadline(conn, p)
+}
+
+func writeWithDeadline(conn net.Conn, p packet) error {
+	conn.SetWriteDeadline(time.Now().Add(publishTimeout))
+	return writePacket(conn, p)
+}
+
+// newPacketID reserves a packet identifier and returns the channel acknowledgements for it
+// are delivered to
+func (c *mqtt5Client) newPacketID() (uint16, chan packet) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for {
+		c.nextID++
+		if _, used := c.pending[c.nextID]; c.nextID != 0 && !used {
+			break
+		}
+	}
+	ch := make(chan packet, 1)
+	c.pending[c.nextID] = ch
+	return c.nextID, ch
+}
+
+func (c *mqtt5Client) releasePacketID(id uint16) {
+	c.mutex.Lock()
+	delete(c.pending, id)
+	c.mutex.Unlock()
+}
+
+// awaitAck waits for an acknowledgement and checks its reason code
+func (c *mqtt5Client) awaitAck(ch chan packet, kind byte) error {
+	select {
+	case p, ok := <-ch:
+		if !ok {
+			return errNotConnected
+		}
+		if p.kind() != kind {
+			return fmt.Errorf("expected packet type %d, received %d", kind, p.kind())
+		}
+		return ackReasonCodes(p)
+	case <-time.After(publishTimeout):
+		return errors.New("timeout waiting for acknowledgement")
+	}
+}
+
+// ackReasonCodes checks the reason codes of an acknowledgement. PUBACK, PUBREC and PUBCOMP
+// carry an optional reason code after the packet identifier, SUBACK and UNSUBACK one reason
+// code per topic filter after their properties.
+func ackReasonCodes(p packet) error {
+	r := packetReader{data: p.body}
+	r.uint16()
+	var codes []byte
+	switch p.kind() {
+	case packetSuback, packetUnsuback:
+		r.properties()
+		codes = r.remaining()
+		if len(codes) == 0 {
+			r.err = errMalformedPacket
+		}
+	default:
+		codes = r.remaining()
+		if len(codes) > 1 {
+			codes = codes[:1]
+		}
+	}
+	if r.err != nil {
+		return r.err
+	}
+	for _, code := range codes {
+		if code >= 0x80 {
+			return fmt.Errorf("rejected by broker with reason code 0x%02x", code)
+		}
+	}
+	return nil
+}
+
+func (c *mqtt5Client) resubscribe() {
+	c.mutex.Lock()
+	subscriptions := make(map[string]byte, len(c.subscriptions))
+	for topic, qos := range c.subscriptions {
+		subscriptions[topic] = qos
+	}
+	c.mutex.Unlock()
+
+	for topic, qos := range subscriptions {
+		c.Subscribe(topic, qos)
+	}
+}
+
+func (c *mqtt5Client) replay(messages []queuedMessage) {
+	for i, m := range messages {
+		if err := c.publish(m); err != nil {
+			c.queue.requeue(messages[i:])
+			return
+		}
+	}
+	if len(messages) > 0 {
+		log.WithFields(log.Fields{
+			"component": "Mqtt5Client",
+			"messages":  len(messages),
+		}).Info("Published queued messages")
+	}
+}
+
+func (c *mqtt5Client) Publish(topic string, qos byte, retained bool, payload interface{}) bool {
+	return c.PublishWithProperties(topic, qos, retained, payload, nil)
+}
+
+// PublishWithProperties sends a message including its MQTT 5 properties. If the broker cannot
+// be reached, messages with QoS > 0 are queued for later delivery.
+func (c *mqtt5Client) PublishWithProperties(topic string, qos byte, retained bool, payload interface{}, properties *MessageProperties) bool {
+	m := queuedMessage{topic, qos, retained, payload, properties}
+
+	c.mutex.Lock()
+	online := c.online
+	queued := !online && c.queue.push(m)
+	c.mutex.Unlock()
+
+	if online {
+		err := c.publish(m)
+		if err == nil {
+			log.WithFields(log.Fields{
+				"component": "Mqtt5Client",
+				"topic":     topic,
+			}).Debug("Published message")
+			return true
+		}
+		log.WithFields(log.Fields{
+			"component": "Mqtt5Client",
+			"topic":     topic,
+			"error":     err,
+		}).Error("Error publishing message")
+		queued = c.queue.push(m)
+	}
+	if queued {
+		log.WithFields(log.Fields{
+			"component": "Mqtt5Client",
+			"topic":     topic,
+		}).Debug("Queued message until connection is restored")
+	}
+	return queued
+}
+
+func (c *mqtt5Client) publish(m queuedMessage) error {
+	var payload []byte
+	switch p := m.payload.(type) {
+	case string:
+		payload = []byte(p)
+	case []byte:
+		payload = p
+	default:
+		return fmt.Errorf("unknown payload type %T", m.payload)
+	}
+
+	var id uint16
+	var ch chan packet
+	if m.qos > 0 {
+		id, ch = c.newPacketID()
+		defer c.releasePacketID(id)
+	}
+
+	// Packets are written while holding the write mutex, so that a topic alias is always
+	// established before it is used on its own
+	c.writeMutex.Lock()
+	c.mutex.Lock()
+	conn := c.conn
+	properties := newPacketProperties(m.properties)
+	topic := m.topic
+	if alias, exists := c.topicAliases[topic]; exists {
+		properties.topicAlias = alias
+		topic = ""
+	} else if len(c.topicAliases) < int(c.topicAliasMax) {
+		properties.topicAlias = uint16(len(c.topicAliases) + 1)
+		c.topicAliases[topic] = properties.topicAlias
+	}
+	c.mutex.Unlock()
+
+	var w packetWriter
+	w.string(topic)
+	if m.qos > 0 {
+		w.uint16(id)
+	}
+	w.properties(properties)
+	w.Write(payload)
+
+	header := packetPublish<<4 | m.qos<<1
+	if m.retained {
+		header |= 0x01
+	}
+	err := errNotConnected
+	if conn != nil {
+		err = writeWithDeadline(conn, w.packet(header))
+	}
+	c.writeMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	switch m.qos {
+	case 1:
+		return c.awaitAck(ch, packetPuback)
+	case 2:
+		if err := c.awaitAck(ch, packetPubrec); err != nil {
+			return err
+		}
+		if err := c.writeTo(conn, ackPacket(packetPubrel<<4|0x02, id)); err != nil {
+			return err
+		}
+		return c.awaitAck(ch, packetPubcomp)
+	}
+	return nil
+}
+
+func (c *mqtt5Client) Subscribe(topic string, qos byte) bool {
+	id, ch := c.newPacketID()
+	defer c.releasePacketID(id)
+
+	var w packetWriter
+	w.uint16(id)
+	w.properties(nil)
+	w.string(topic)
+	w.WriteByte(qos)
+
+	err := c.write(w.packet(packetSubscribe<<4 | 0x02))
+	if err == nil {
+		err = c.awaitAck(ch, packetSuback)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"component": "Mqtt5Client",
+			"topic":     topic,
+			"error":     err,
+		}).Error("Error subscribing to MQTT topic")
+		return false
+	}
+	c.mutex.Lock()
+	c.subscriptions[topic] = qos
+	c.mutex.Unlock()
+	log.WithFields(log.Fields{
+		"component": "Mqtt5Client",
+		"topic":     topic,
+	}).Debug("Subscribed to MQTT topic")
+	return true
+}
+
+func (c *mqtt5Client) Unsubscribe(topics ...string) bool {
+	id, ch := c.newPacketID()
+	defer c.releasePacketID(id)
+
+	var w packetWriter
+	w.uint16(id)
+	w.properties(nil)
+	for _, topic := range topics {
+		w.string(topic)
+	}
+
+	err := c.write(w.packet(packetUnsubscribe<<4 | 0x02))
+	if err == nil {
+		err = c.awaitAck(ch, packetUnsuback)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"component": "Mqtt5Client",
+			"topic":     topics,
+			"error":     err,
+		}).Error("Error unsubscribing from MQTT topics")
+		return false
+	}
+	c.mutex.Lock()
+	for _, topic := range topics {
+		delete(c.subscriptions, topic)
+	}
+	c.mutex.Unlock()
+	log.WithFields(log.Fields{
+		"component": "Mqtt5Client",
+		"topic":     topics,
+	}).Debug("Unsubscribed from MQTT topics")
+	return true
+}
+
+func newPacketProperties(m *MessageProperties) *packetProperties {
+	p := &packetProperties{}
+	if m == nil {
+		return p
+	}
+	p.messageExpiry = m.MessageExpiry
+	p.contentType = m.ContentType
+	p.responseTopic = m.ResponseTopic
+	p.correlationData = []byte(m.CorrelationData)
+	for key, value := range m.UserProperties {
+		p.userProperties = append(p.userProperties, [2]string{key, value})
+	}
+	return p
+}
+
+func (p *packetProperties) messageProperties() *MessageProperties {
+	m := &MessageProperties{
+		ContentType:     p.contentType,
+		ResponseTopic:   p.responseTopic,
+		CorrelationData: string(p.correlationData),
+		MessageExpiry:   p.messageExpiry,
+	}
+	if len(p.userProperties) > 0 {
+		m.UserProperties = make(map[string]string)
+		for _, up := range p.userProperties {
+			m.UserProperties[up[0]] = up[1]
+		}
+	}
+	return m
+}
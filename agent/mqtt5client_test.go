@@ -0,0 +1,234 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crenz/mqttrules/test"
+	"github.com/davecgh/go-spew/spew"
+)
+
+func newTestBroker(t *testing.T) *test.MockBroker {
+	broker, err := test.NewBroker(nil)
+	if err != nil {
+		t.Fatalf("Failed to start broker: %v", err)
+	}
+	return broker
+}
+
+func TestNewClientFromConfig(t *testing.T) {
+	for version, expected := range map[int]bool{0: false, 3: false, 4: false, 5: true} {
+		c, err := NewClientFromConfig(Config{Broker: "tcp://localhost:1883", ProtocolVersion: version})
+		if err != nil {
+			t.Errorf("Failed to create client for protocol version %d: %v", version, err)
+			continue
+		}
+		if _, isMqtt5 := c.(Mqtt5Client); isMqtt5 != expected {
+			t.Errorf("Wrong client type for protocol version %d", version)
+		}
+	}
+	if _, err := NewClientFromConfig(Config{ProtocolVersion: 6}); err == nil {
+		t.Errorf("NewClientFromConfig should fail for unsupported protocol version")
+	}
+}
+
+func TestMqtt5Client_Properties(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.Close()
+
+	agentClient := NewMqtt5Client(Mqtt5Options{Broker: broker.Address(), ClientID: "agent"})
+	a := New(agentClient, "")
+	if !a.Connect() {
+		t.Fatalf("Failed to connect to broker")
+	}
+	defer a.Disconnect()
+	a.AddRuleFromString("test", "properties", `{
+		"trigger": "request",
+		"condition": "contentType() == 'application/json' && userProperty('source') == 'test'",
+		"actions": [{
+			"topic": "response",
+			"payload": "${payload('$.value')}",
+			"qos": 1,
+			"contentType": "text/plain",
+			"responseTopic": "${responseTopic()}/ack",
+			"correlationData": "${correlationData()}",
+			"userProperties": {"source": "${userProperty('source')}"},
+			"messageExpiry": 60
+		}]
+	}`)
+
+	type response struct {
+		topic      string
+		payload    string
+		properties *MessageProperties
+	}
+	received := make(chan response, 1)
+	peer := NewMqtt5Client(Mqtt5Options{Broker: broker.Address(), ClientID: "peer"})
+	peer.SetMessageCallback(func(topic string, payload string, properties *MessageProperties) {
+		received <- response{topic, payload, properties}
+	})
+	if !peer.Connect() || !peer.Subscribe("response", 1) {
+		t.Fatalf("Failed to connect and subscribe")
+	}
+	defer peer.Disconnect()
+
+	go a.Listen()
+	peer.PublishWithProperties("request", 1, false, `{"value": 42}`, &MessageProperties{
+		ContentType:     "application/json",
+		ResponseTopic:   "response",
+		CorrelationData: "abc",
+		UserProperties:  map[string]string{"source": "test"},
+	})
+
+	select {
+	case r := <-received:
+		p := r.properties
+		if r.topic != "response" || r.payload != "42" || p.ContentType != "text/plain" || p.ResponseTopic != "response/ack" ||
+			p.CorrelationData != "abc" || p.UserProperties["source"] != "test" || p.MessageExpiry != 60 {
+			t.Errorf("Unexpected response")
+			spew.Dump(r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No response received")
+	}
+}
+
+func TestMqtt5Client_TopicAliases(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.Close()
+
+	c := NewMqtt5Client(Mqtt5Options{Broker: broker.Address(), ClientID: "alias"})
+	if !c.Connect() {
+		t.Fatalf("Failed to connect to broker")
+	}
+	defer c.Disconnect()
+
+	for i := 0; i < 3; i++ {
+		c.Publish("aliased/topic", 1, false, "value")
+	}
+	if n := broker.AliasedMessages(); n != 2 {
+		t.Errorf("Expected 2 messages sent using topic alias, got %d", n)
+	}
+	for _, m := range broker.Messages() {
+		if m.Topic != "aliased/topic" {
+			t.Errorf("Topic alias resolved to wrong topic %s", m.Topic)
+		}
+	}
+}
+
+func TestMqtt5Client_Will(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.Close()
+
+	c, err := NewClientFromConfig(Config{Broker: broker.Address(), ClientID: "will", Prefix: "home/", ProtocolVersion: 5})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if !c.Connect() {
+		t.Fatalf("Failed to connect to broker")
+	}
+	defer c.Disconnect()
+
+	if w := broker.Will(); w == nil || w.Topic != StatusTopic("home/") || w.Payload != StatusOffline || w.QoS != 1 || !w.Retained {
+		t.Errorf("Unexpected last will")
+		spew.Dump(w)
+	}
+}
+
+func TestMqtt5Client_Queue(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.Close()
+
+	c := NewMqtt5Client(Mqtt5Options{Broker: broker.Address(), ClientID: "queue"})
+	c.(*mqtt5Client).reconnectInterval = 10 * time.Millisecond
+	connection := make(chan bool, 10)
+	c.SetConnectionCallback(func(connected bool) { connection <- connected })
+
+	if !c.Connect() {
+		t.Fatalf("Failed to connect to broker")
+	}
+	defer c.Disconnect()
+	<-connection
+
+	// Keep the broker down until the messages are published, so that they are queued
+	broker.Pause()
+	if connected := <-connection; connected {
+		t.Fatalf("Connection loss not reported")
+	}
+	if c.Publish("qos0", 0, false, "lost") {
+		t.Errorf("QoS 0 message should not be queued")
+	}
+	if !c.Publish("qos1", 1, false, "queued") {
+		t.Errorf("QoS 1 message should be queued")
+	}
+	broker.Resume()
+
+	select {
+	case connected := <-connection:
+		if !connected {
+			t.Fatalf("Unexpected connection state")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Connection not restored")
+	}
+
+	var topics []string
+	for _, m := range broker.Messages() {
+		topics = append(topics, m.Topic)
+	}
+	if len(topics) != 1 || topics[0] != "qos1" {
+		t.Errorf("Expected queued message to be published after reconnecting, got %v", topics)
+	}
+}
+
+func TestMqtt5Client_SubscribeReasonCodes(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.Close()
+
+	c := NewMqtt5Client(Mqtt5Options{Broker: broker.Address(), ClientID: "suback"})
+	if !c.Connect() {
+		t.Fatalf("Failed to connect to broker")
+	}
+	defer c.Disconnect()
+
+	broker.SetSubackResponse(0x80, "")
+	if c.Subscribe("rejected", 1) {
+		t.Errorf("Subscription rejected with reason code 0x80 reported as successful")
+	}
+	broker.SetSubackResponse(0x87, "not authorized")
+	if c.Subscribe("unauthorized", 1) {
+		t.Errorf("Subscription rejected with reason code 0x87 reported as successful")
+	}
+	broker.SetSubackResponse(0x01, strings.Repeat("x", 200))
+	if !c.Subscribe("granted", 1) {
+		t.Errorf("Subscription with long reason string reported as rejected")
+	}
+	if !c.Unsubscribe("granted") {
+		t.Errorf("Unsubscribe reported as rejected")
+	}
+}
+
+func TestMqtt5Client_IsConnected(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.Close()
+
+	c := NewMqtt5Client(Mqtt5Options{Broker: broker.Address(), ClientID: "connected"})
+	c.(*mqtt5Client).reconnectInterval = time.Hour
+	connection := make(chan bool, 10)
+	c.SetConnectionCallback(func(connected bool) { connection <- connected })
+	if c.IsConnected() {
+		t.Errorf("Client reported as connected before connecting")
+	}
+	if !c.Connect() || !c.IsConnected() {
+		t.Fatalf("Failed to connect to broker")
+	}
+	defer c.Disconnect()
+	<-connection
+
+	broker.DropConnections()
+	<-connection
+	if c.IsConnected() {
+		t.Errorf("Client reported as connected while reconnecting")
+	}
+}
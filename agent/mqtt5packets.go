@@ -0,0 +1,330 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MQTT 5 control packet types
+const (
+	packetConnect     byte = 1
+	packetConnack     byte = 2
+	packetPublish     byte = 3
+	packetPuback      byte = 4
+	packetPubrec      byte = 5
+	packetPubrel      byte = 6
+	packetPubcomp     byte = 7
+	packetSubscribe   byte = 8
+	packetSuback      byte = 9
+	packetUnsubscribe byte = 10
+	packetUnsuback    byte = 11
+	packetPingreq     byte = 12
+	packetPingresp    byte = 13
+	packetDisconnect  byte = 14
+)
+
+// MQTT 5 property identifiers used by the client
+const (
+	propPayloadFormat     byte = 0x01
+	propMessageExpiry     byte = 0x02
+	propContentType       byte = 0x03
+	propResponseTopic     byte = 0x08
+	propCorrelationData   byte = 0x09
+	propSessionExpiry     byte = 0x11
+	propServerKeepAlive   byte = 0x13
+	propReasonString      byte = 0x1f
+	propTopicAliasMaximum byte = 0x22
+	propTopicAlias        byte = 0x23
+	propUserProperty      byte = 0x26
+)
+
+// Value types of MQTT 5 properties, needed to skip properties the client does not use
+const (
+	propTypeByte = iota
+	propTypeUint16
+	propTypeUint32
+	propTypeVarInt
+	propTypeString
+	propTypeBinary
+	propTypeStringPair
+)
+
+var propertyTypes = map[byte]int{
+	0x01: propTypeByte, 0x02: propTypeUint32, 0x03: propTypeString, 0x08: propTypeString,
+	0x09: propTypeBinary, 0x0b: propTypeVarInt, 0x11: propTypeUint32, 0x12: propTypeString,
+	0x13: propTypeUint16, 0x15: propTypeString, 0x16: propTypeBinary, 0x17: propTypeByte,
+	0x18: propTypeUint32, 0x19: propTypeByte, 0x1a: propTypeString, 0x1c: propTypeString,
+	0x1f: propTypeString, 0x21: propTypeUint16, 0x22: propTypeUint16, 0x23: propTypeUint16,
+	0x24: propTypeByte, 0x25: propTypeByte, 0x26: propTypeStringPair, 0x27: propTypeUint32,
+	0x28: propTypeByte, 0x29: propTypeByte, 0x2a: propTypeByte,
+}
+
+var errMalformedPacket = errors.New("malformed MQTT packet")
+
+// packet is a raw MQTT control packet
+type packet struct {
+	header byte
+	body   []byte
+}
+
+func (p packet) kind() byte {
+	return p.header >> 4
+}
+
+// packetProperties holds the decoded properties of a packet
+type packetProperties struct {
+	payloadFormat     byte
+	messageExpiry     uint32
+	contentType       string
+	responseTopic     string
+	correlationData   []byte
+	serverKeepAlive   uint16
+	reasonString      string
+	topicAliasMaximum uint16
+	topicAlias        uint16
+	userProperties    [][2]string
+}
+
+/* Encoding */
+
+type packetWriter struct {
+	bytes.Buffer
+}
+
+func (w *packetWriter) uint16(v uint16) {
+	w.WriteByte(byte(v >> 8))
+	w.WriteByte(byte(v))
+}
+
+func (w *packetWriter) uint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	w.Write(b[:])
+}
+
+func (w *packetWriter) varInt(v int) {
+	for {
+		b := byte(v % 128)
+		v /= 128
+		if v > 0 {
+			b |= 0x80
+		}
+		w.WriteByte(b)
+		if v == 0 {
+			return
+		}
+	}
+}
+
+func (w *packetWriter) binary(b []byte) {
+	w.uint16(uint16(len(b)))
+	w.Write(b)
+}
+
+func (w *packetWriter) string(s string) {
+	w.binary([]byte(s))
+}
+
+func (w *packetWriter) properties(p *packetProperties) {
+	var pw packetWriter
+	if p != nil {
+		if p.payloadFormat != 0 {
+			pw.WriteByte(propPayloadFormat)
+			pw.WriteByte(p.payloadFormat)
+		}
+		if p.messageExpiry != 0 {
+			pw.WriteByte(propMessageExpiry)
+			pw.uint32(p.messageExpiry)
+		}
+		if len(p.contentType) > 0 {
+			pw.WriteByte(propContentType)
+			pw.string(p.contentType)
+		}
+		if len(p.responseTopic) > 0 {
+			pw.WriteByte(propResponseTopic)
+			pw.string(p.responseTopic)
+		}
+		if len(p.correlationData) > 0 {
+			pw.WriteByte(propCorrelationData)
+			pw.binary(p.correlationData)
+		}
+		if p.topicAliasMaximum != 0 {
+			pw.WriteByte(propTopicAliasMaximum)
+			pw.uint16(p.topicAliasMaximum)
+		}
+		if p.topicAlias != 0 {
+			pw.WriteByte(propTopicAlias)
+			pw.uint16(p.topicAlias)
+		}
+		for _, up := range p.userProperties {
+			pw.WriteByte(propUserProperty)
+			pw.string(up[0])
+			pw.string(up[1])
+		}
+	}
+	w.varInt(pw.Len())
+	w.Write(pw.Bytes())
+}
+
+func (w *packetWriter) packet(header byte) packet {
+	return packet{header, w.Bytes()}
+}
+
+func writePacket(out io.Writer, p packet) error {
+	var w packetWriter
+	w.WriteByte(p.header)
+	w.varInt(len(p.body))
+	w.Write(p.body)
+	_, err := out.Write(w.Bytes())
+	return err
+}
+
+/* Decoding */
+
+type packetReader struct {
+	data []byte
+	err  error
+}
+
+func (r *packetReader) take(n int) []byte {
+	if r.err != nil || n > len(r.data) {
+		r.err = errMalformedPacket
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *packetReader) byte() byte {
+	if b := r.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *packetReader) uint16() uint16 {
+	if b := r.take(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *packetReader) uint32() uint32 {
+	if b := r.take(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *packetReader) varInt() int {
+	v := 0
+	for shift := uint(0); shift < 28; shift += 7 {
+		b := r.byte()
+		v |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return v
+		}
+	}
+	r.err = errMalformedPacket
+	return 0
+}
+
+func (r *packetReader) binary() []byte {
+	return r.take(int(r.uint16()))
+}
+
+func (r *packetReader) string() string {
+	return string(r.binary())
+}
+
+func (r *packetReader) remaining() []byte {
+	b := r.data
+	r.data = nil
+	return b
+}
+
+func (r *packetReader) properties() *packetProperties {
+	p := &packetProperties{}
+	pr := packetReader{data: r.take(r.varInt())}
+	for r.err == nil && pr.err == nil && len(pr.data) > 0 {
+		id := pr.byte()
+		switch id {
+		case propPayloadFormat:
+			p.payloadFormat = pr.byte()
+		case propMessageExpiry:
+			p.messageExpiry = pr.uint32()
+		case propContentType:
+			p.contentType = pr.string()
+		case propResponseTopic:
+			p.responseTopic = pr.string()
+		case propCorrelationData:
+			p.correlationData = pr.binary()
+		case propServerKeepAlive:
+			p.serverKeepAlive = pr.uint16()
+		case propReasonString:
+			p.reasonString = pr.string()
+		case propTopicAliasMaximum:
+			p.topicAliasMaximum = pr.uint16()
+		case propTopicAlias:
+			p.topicAlias = pr.uint16()
+		case propUserProperty:
+			p.userProperties = append(p.userProperties, [2]string{pr.string(), pr.string()})
+		default:
+			t, known := propertyTypes[id]
+			if !known {
+				pr.err = fmt.Errorf("unknown MQTT property 0x%02x", id)
+				break
+			}
+			switch t {
+			case propTypeByte:
+				pr.take(1)
+			case propTypeUint16:
+				pr.take(2)
+			case propTypeUint32:
+				pr.take(4)
+			case propTypeVarInt:
+				pr.varInt()
+			case propTypeString, propTypeBinary:
+				pr.binary()
+			case propTypeStringPair:
+				pr.binary()
+				pr.binary()
+			}
+		}
+	}
+	if r.err == nil {
+		r.err = pr.err
+	}
+	return p
+}
+
+func readPacket(in *bufio.Reader) (packet, error) {
+	header, err := in.ReadByte()
+	if err != nil {
+		return packet{}, err
+	}
+	length := 0
+	for shift := uint(0); ; shift += 7 {
+		b, err := in.ReadByte()
+		if err != nil {
+			return packet{}, err
+		}
+		if shift >= 28 {
+			return packet{}, errMalformedPacket
+		}
+		length |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(in, body); err != nil {
+		return packet{}, err
+	}
+	return packet{header, body}, nil
+}
@@ -0,0 +1,203 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/Knetic/govaluate"
+	log "github.com/Sirupsen/logrus"
+)
+
+// Parameter names are hierarchical, with levels separated by dots: the parameter
+// kitchen.light.state is set via the topic param/kitchen/light/state and belongs to the groups
+// kitchen and kitchen.light.
+
+// parameterName converts a topic path like kitchen/light/state to a parameter name
+func parameterName(path string) string {
+	return strings.Replace(strings.Trim(path, "/"), "/", ".", -1)
+}
+
+// parameterPath converts a parameter name to a topic path
+func parameterPath(name string) string {
+	return strings.Replace(name, ".", "/", -1)
+}
+
+// inGroup checks whether the parameter name is group itself or belongs to it. All parameters
+// belong to the empty group.
+func inGroup(name string, group string) bool {
+	return len(group) == 0 || name == group || strings.HasPrefix(name, group+".")
+}
+
+// newExpression parses an expression, allowing hierarchical parameter names like
+// kitchen.light.state as variables. It is evaluated with evaluate.
+func newExpression(e string, functions map[string]govaluate.ExpressionFunction) (*govaluate.EvaluableExpression, error) {
+	return govaluate.NewEvaluableExpressionWithFunctions(rewriteAccessors(e), expressionFunctions(functions))
+}
+
+// rewriteAccessors escapes dotted variable names, which govaluate does not support, e.g.
+// "kitchen.light.state == 'on'" becomes "[kitchen.light.state] == 'on'". String literals and
+// escaped variables are left unchanged.
+func rewriteAccessors(e string) string {
+	var out bytes.Buffer
+	runes := []rune(e)
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		j := i + 1
+		switch {
+		case c == '\'' || c == '"' || c == '[':
+			end := c
+			if c == '[' {
+				end = ']'
+			}
+			for j < len(runes) && runes[j] != end {
+				if runes[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j < len(runes) {
+				j++
+			}
+			out.WriteString(string(runes[i:j]))
+		case isNameStart(c):
+			// A level starting with a digit is not part of the name, e.g. x1.5
+			dotted := false
+			for j < len(runes) && (isNameCharacter(runes[j]) ||
+				(runes[j] == '.' && j+1 < len(runes) && isNameStart(runes[j+1]))) {
+				dotted = dotted || runes[j] == '.'
+				j++
+			}
+			if string(runes[i:j]) == "get" {
+				if name, end, found := quotedFirstArgument(runes, j); found {
+					// get("name", path) refers to the parameter, other arguments are values
+					out.WriteString("get([" + name + "]")
+					i = end
+					continue
+				}
+			}
+			if dotted || c == '_' {
+				// govaluate does not accept names starting with an underscore either
+				out.WriteString("[" + string(runes[i:j]) + "]")
+			} else {
+				out.WriteString(string(runes[i:j]))
+			}
+		case unicode.IsDigit(c):
+			// Numbers including decimals
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || runes[j] == '.') {
+				j++
+			}
+			out.WriteString(string(runes[i:j]))
+		default:
+			out.WriteRune(c)
+		}
+		i = j
+	}
+	return out.String()
+}
+
+// quotedFirstArgument returns the contents of a string literal directly following the opening
+// parenthesis of a function call starting at runes[i], and the index after the literal
+func quotedFirstArgument(runes []rune, i int) (string, int, bool) {
+	skipSpaces := func() {
+		for i < len(runes) && unicode.IsSpace(runes[i]) {
+			i++
+		}
+	}
+	skipSpaces()
+	if i >= len(runes) || runes[i] != '(' {
+		return "", 0, false
+	}
+	i++
+	skipSpaces()
+	if i >= len(runes) || (runes[i] != '"' && runes[i] != '\'') {
+		return "", 0, false
+	}
+	quote := runes[i]
+	for j := i + 1; j < len(runes); j++ {
+		switch runes[j] {
+		case quote:
+			return string(runes[i+1 : j]), j + 1, j > i+1
+		case '\\', '[', ']':
+			return "", 0, false
+		}
+	}
+	return "", 0, false
+}
+
+func isNameStart(c rune) bool {
+	return unicode.IsLetter(c) || c == '_'
+}
+
+func isNameCharacter(c rune) bool {
+	return unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_'
+}
+
+// parameterNames returns the sorted names of the parameters in group
+func (a *agent) parameterNames(group string) []string {
+	a.paramMutex.Lock()
+	defer a.paramMutex.Unlock()
+	var names []string
+	for name := range a.parameters {
+		if inGroup(name, group) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// publishParameters publishes the definitions of the parameters in group to
+// $MQTTRULES/parameters/<path>
+func (a *agent) publishParameters(group string) {
+	for _, name := range a.parameterNames(group) {
+		a.paramMutex.Lock()
+		s, _ := json.Marshal(a.parameters[name])
+		a.paramMutex.Unlock()
+		a.Publish(fmt.Sprintf("%s$MQTTRULES/parameters/%s", a.prefix, parameterPath(name)), 2, false, string(s))
+	}
+}
+
+// deleteParameters removes the parameters in group, which must not be empty
+func (a *agent) deleteParameters(group string) {
+	if len(group) == 0 {
+		return
+	}
+	for _, name := range a.parameterNames(group) {
+		a.deleteParameter(name)
+	}
+}
+
+func (a *agent) deleteParameter(name string) {
+	a.paramMutex.Lock()
+	p, exists := a.parameters[name]
+	if !exists {
+		a.paramMutex.Unlock()
+		return
+	}
+	delete(a.parameters, name)
+	delete(a.parameterValues, name)
+	delete(a.histories, name)
+	if f, exists := a.freshness[name]; exists && f.timer != nil {
+		f.timer.Stop()
+	}
+	delete(a.freshness, name)
+	_, published := a.publishedValues[name]
+	delete(a.publishedValues, name)
+	a.paramMutex.Unlock()
+
+	if len(p.Topic) > 0 {
+		a.RemoveParameterSubscription(p.Topic, name)
+	}
+	if published {
+		// Clear the retained value
+		a.Publish(ValueTopic(a.prefix, name), 1, true, "")
+	}
+	log.WithFields(log.Fields{
+		"component": "Parameters",
+		"parameter": name,
+	}).Info("Parameter deleted")
+}
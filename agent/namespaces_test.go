@@ -0,0 +1,102 @@
+package agent
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/crenz/mqttrules/test"
+	"github.com/davecgh/go-spew/spew"
+)
+
+func TestRewriteAccessors(t *testing.T) {
+	for in, expected := range map[string]string{
+		"kitchen.light.state == 'on'":            "[kitchen.light.state] == 'on'",
+		"temperature > 21.5":                     "temperature > 21.5",
+		"a.b + max(c.d_1, 2.5) * e":              "[a.b] + max([c.d_1], 2.5) * e",
+		`payload("$.state.on") && x.y`:           `payload("$.state.on") && [x.y]`,
+		"[already.escaped] == 'a.b' || 'x\\'.y'": "[already.escaped] == 'a.b' || 'x\\'.y'",
+		"_a.b == 1":                              "[_a.b] == 1",
+		"a._b_c.d > _x":                          "[a._b_c.d] > [_x]",
+		"x1.5":                                   "x1.5",
+		"x1 + 1.5":                               "x1 + 1.5",
+		"sensors.1.temp":                         "sensors.1.temp",
+		"[sensors.1.temp] > 20":                  "[sensors.1.temp] > 20",
+		`get("kitchen.lamp", "$.on")`:            `get([kitchen.lamp], "$.on")`,
+		`get ( 'lamp', '$.on')`:                  `get([lamp], '$.on')`,
+		`get(raw, "$.on")`:                       `get(raw, "$.on")`,
+		`get(payload("$.state"), "$.on")`:        `get(payload("$.state"), "$.on")`,
+	} {
+		if result := rewriteAccessors(in); result != expected {
+			t.Errorf("rewriteAccessors(%q) == %q, want %q", in, result, expected)
+		}
+	}
+
+	expression, err := newExpression("_a.b + _x", nil)
+	if err != nil {
+		t.Fatalf("Failed to parse names starting with an underscore: %v", err)
+	}
+	if v, err := evaluate(expression, map[string]interface{}{"_a.b": 1.0, "_x": 2.0}); err != nil || v != 3.0 {
+		t.Errorf("_a.b + _x == %v (%v), want 3", v, err)
+	}
+}
+
+func TestAgent_ParameterNamespaces(t *testing.T) {
+	mqttClient := test.NewClient()
+	a := New(mqttClient, "mr/")
+	mqttClient.SetSubscriptionCallback(nil)
+
+	a.HandleMessage("mr/param/kitchen/light/state", []byte(`{"value": "on", "publish": true}`))
+	a.HandleMessage("mr/param/kitchen/light/brightness", []byte("80"))
+	a.HandleMessage("mr/param/kitchen/temperature", []byte("21"))
+	a.HandleMessage("mr/param/hall/light/state", []byte("off"))
+	if v := a.GetParameterValue("kitchen.light.state"); v != "on" {
+		t.Errorf("kitchen.light.state == %v, want on", v)
+	}
+
+	a.AddRuleFromString("lights", "kitchen", `{
+		"condition": "kitchen.light.state == 'on' && kitchen.light.brightness > 50",
+		"actions": [{"topic": "out", "payload": "${kitchen.temperature + 1}"}]
+	}`)
+	a.ExecuteRule("lights", "kitchen", "")
+	if m := mqttClient.LastMessage(); m.Topic != "out" || m.Payload != "22" {
+		t.Error("Unexpected message for rule using hierarchical parameters")
+		spew.Dump(m)
+	}
+
+	// The mock client passes published messages to the subscription callback
+	messages := make(chan string, 10)
+	mqttClient.SetSubscriptionCallback(func(topic string, payload string) { messages <- topic })
+
+	a.HandleMessage("mr/$MQTTRULES", []byte("parameters kitchen.light"))
+	if published := receivedTopics(messages); len(published) != 2 ||
+		published[0] != "mr/$MQTTRULES/parameters/kitchen/light/brightness" ||
+		published[1] != "mr/$MQTTRULES/parameters/kitchen/light/state" {
+		t.Error("Unexpected parameters listed for group")
+		spew.Dump(published)
+	}
+
+	a.HandleMessage("mr/$MQTTRULES", []byte("deleteParameters kitchen/light"))
+	if a.GetParameterValue("kitchen.light.state") != "" || a.GetParameterValue("kitchen.light.brightness") != "" ||
+		a.GetParameterValue("kitchen.temperature") != 21.0 || a.GetParameterValue("hall.light.state") != "off" {
+		t.Error("Only the parameters of the group should be deleted")
+	}
+	if published := receivedTopics(messages); len(published) != 1 || published[0] != "mr/value/kitchen/light/state" {
+		t.Error("Retained value of deleted parameter should be cleared")
+		spew.Dump(published)
+	}
+}
+
+// receivedTopics collects the topics sent to messages until no more arrive, sorted
+func receivedTopics(messages chan string) []string {
+	var topics []string
+	for {
+		select {
+		case topic := <-messages:
+			topics = append(topics, topic)
+		case <-time.After(50 * time.Millisecond):
+			sort.Strings(topics)
+			return topics
+		}
+	}
+}
@@ -1,15 +1,22 @@
 package agent
 
 import (
+	"sync"
+	"time"
+
 	log "github.com/Sirupsen/logrus"
 	"github.com/eclipse/paho.mqtt.golang"
 )
 
+// Time to wait for the broker to acknowledge a published message
+const publishTimeout = 5 * time.Second
+
 type PahoClient interface {
 	IsConnected() bool
 	Connect() bool
 	Disconnect()
 	SetSubscriptionCallback(callback func(string, string))
+	SetConnectionCallback(callback func(bool))
 	Publish(topic string, qos byte, retained bool, payload interface{}) bool
 	Subscribe(topic string, qos byte) bool
 	Unsubscribe(topics ...string) bool
@@ -18,24 +25,47 @@ type PahoClient interface {
 type pahoClient struct {
 	c                    mqtt.Client
 	subscriptionCallback func(string, string)
+	connectionCallback   func(bool)
 	subscriptions        map[string]byte
+	queue                *publishQueue
+	online               bool
+	mutex                sync.Mutex
 }
 
+// NewPahoClient creates a client based on the Paho MQTT library. While the connection to the
+// broker is down, messages with QoS > 0 are queued and published after reconnecting.
 func NewPahoClient(o *mqtt.ClientOptions) PahoClient {
+	return newPahoClient(o, DefaultQueueSize)
+}
+
+func newPahoClient(o *mqtt.ClientOptions, queueSize int) *pahoClient {
 	c := &pahoClient{}
 	c.subscriptions = make(map[string]byte)
+	c.queue = newPublishQueue(queueSize)
 
 	pahoOnConnectHandler := func(cm mqtt.Client) {
 		log.WithFields(log.Fields{
 			"component": "PahoClient",
 		}).Debug("Established connection to broker")
 		c.resubscribe()
+		c.mutex.Lock()
+		c.online = true
+		messages := c.queue.take()
+		c.mutex.Unlock()
+		c.replay(messages)
+		if c.connectionCallback != nil {
+			c.connectionCallback(true)
+		}
 	}
 	o.SetOnConnectHandler(pahoOnConnectHandler)
 	pahoConnectionLostHandler := func(cm mqtt.Client, e error) {
 		log.WithFields(log.Fields{
 			"component": "PahoClient",
 		}).Debugf("Lost connection to broker: %v", e)
+		c.setOnline(false)
+		if c.connectionCallback != nil {
+			c.connectionCallback(false)
+		}
 	}
 	o.SetConnectionLostHandler(pahoConnectionLostHandler)
 
@@ -43,21 +73,75 @@ func NewPahoClient(o *mqtt.ClientOptions) PahoClient {
 	return c
 }
 
+// NewPahoClientFromConfig creates a Paho MQTT client using the broker, credentials and TLS
+// settings in c
+func NewPahoClientFromConfig(c Config) (PahoClient, error) {
+	o := mqtt.NewClientOptions()
+	o.SetClientID(c.ClientID)
+	o.AddBroker(c.Broker)
+	o.SetUsername(c.Username)
+	o.SetPassword(c.Password)
+	o.SetWill(StatusTopic(c.Prefix), StatusOffline, 1, true)
+	if c.ProtocolVersion > 0 {
+		o.SetProtocolVersion(uint(c.ProtocolVersion))
+	}
+
+	tlsConfig, err := NewTLSConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		o.SetTLSConfig(tlsConfig)
+	}
+
+	return newPahoClient(o, c.QueueSize), nil
+}
+
 func (c *pahoClient) IsConnected() bool {
 	return c.c.IsConnected()
 }
 
+func (c *pahoClient) setOnline(online bool) {
+	c.mutex.Lock()
+	c.online = online
+	c.mutex.Unlock()
+}
+
 func (c *pahoClient) resubscribe() {
+	c.mutex.Lock()
+	subscriptions := make(map[string]byte, len(c.subscriptions))
 	for topic, qos := range c.subscriptions {
+		subscriptions[topic] = qos
+	}
+	c.mutex.Unlock()
+
+	for topic, qos := range subscriptions {
 		c.Subscribe(topic, qos)
 	}
 }
 
+// replay publishes the messages queued while the connection was down
+func (c *pahoClient) replay(messages []queuedMessage) {
+	for i, m := range messages {
+		if !c.publish(m) {
+			c.queue.requeue(messages[i:])
+			return
+		}
+	}
+	if len(messages) > 0 {
+		log.WithFields(log.Fields{
+			"component": "PahoClient",
+			"messages":  len(messages),
+		}).Info("Published queued messages")
+	}
+}
+
 func (c *pahoClient) Connect() bool {
 	if token := c.c.Connect(); token.Wait() && token.Error() != nil {
 		log.Errorf("[PahoClient] Error connecting to MQTT broker: %v", token.Error())
 		return false
 	}
+	c.setOnline(true)
 	log.WithFields(log.Fields{
 		"component": "PahoClient",
 	}).Debug("Connected to MQTT broker successfully")
@@ -65,6 +149,7 @@ func (c *pahoClient) Connect() bool {
 }
 
 func (c *pahoClient) Disconnect() {
+	c.setOnline(false)
 	c.c.Disconnect(250)
 }
 
@@ -72,18 +157,58 @@ func (c *pahoClient) SetSubscriptionCallback(callback func(string, string)) {
 	c.subscriptionCallback = callback
 }
 
+// SetConnectionCallback sets a function that is called whenever the connection to the broker
+// is established (true) or lost (false)
+func (c *pahoClient) SetConnectionCallback(callback func(bool)) {
+	c.connectionCallback = callback
+}
+
+// Publish sends a message to the broker. If the broker cannot be reached, messages with
+// QoS > 0 are queued for later delivery; Publish only returns false if the message is lost.
 func (c *pahoClient) Publish(topic string, qos byte, retained bool, payload interface{}) bool {
-	if token := c.c.Publish(topic, qos, retained, payload); token.Wait() && token.Error() != nil {
+	m := queuedMessage{topic, qos, retained, payload, nil}
+
+	c.mutex.Lock()
+	online := c.online
+	queued := !online && c.queue.push(m)
+	c.mutex.Unlock()
+
+	if online {
+		if c.publish(m) {
+			return true
+		}
+		queued = c.queue.push(m)
+	}
+	if queued {
 		log.WithFields(log.Fields{
 			"component": "PahoClient",
 			"topic":     topic,
+		}).Debug("Queued message until connection is restored")
+	}
+	return queued
+}
+
+func (c *pahoClient) publish(m queuedMessage) bool {
+	token := c.c.Publish(m.topic, m.qos, m.retained, m.payload)
+	if !token.WaitTimeout(publishTimeout) {
+		// Paho keeps the message in its store and delivers it once the broker responds
+		log.WithFields(log.Fields{
+			"component": "PahoClient",
+			"topic":     m.topic,
+		}).Warn("Publishing message not acknowledged yet")
+		return true
+	}
+	if token.Error() != nil {
+		log.WithFields(log.Fields{
+			"component": "PahoClient",
+			"topic":     m.topic,
 			"error":     token.Error(),
 		}).Error("Error publishing message")
 		return false
 	}
 	log.WithFields(log.Fields{
 		"component": "PahoClient",
-		"topic":     topic,
+		"topic":     m.topic,
 	}).Debug("Published message")
 	return true
 }
@@ -101,7 +226,9 @@ func (c *pahoClient) Subscribe(topic string, qos byte) bool {
 		}).Error("Error subscribing to MQTT topic")
 		return false
 	}
+	c.mutex.Lock()
 	c.subscriptions[topic] = qos
+	c.mutex.Unlock()
 	log.WithFields(log.Fields{
 		"component": "PahoClient",
 		"topic":     topic,
@@ -118,9 +245,11 @@ func (c *pahoClient) Unsubscribe(topics ...string) bool {
 		}).Error("Error unsubscribingfrom MQTT topics")
 		return false
 	}
+	c.mutex.Lock()
 	for _, topic := range topics {
 		delete(c.subscriptions, topic)
 	}
+	c.mutex.Unlock()
 	log.WithFields(log.Fields{
 		"component": "PahoClient",
 		"topic":     topics,
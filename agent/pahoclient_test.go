@@ -2,7 +2,9 @@ package agent
 
 import (
 	"testing"
+	"time"
 
+	"github.com/crenz/mqttrules/test"
 	"github.com/eclipse/paho.mqtt.golang"
 )
 
@@ -20,3 +22,54 @@ func TestPahoClient(t *testing.T) {
 	c.Subscribe("topic", 1)
 	c.Unsubscribe("topic")
 }
+
+func TestPahoClient_Queue(t *testing.T) {
+	broker, err := test.NewBroker(nil)
+	if err != nil {
+		t.Fatalf("Failed to start broker: %v", err)
+	}
+	defer broker.Close()
+
+	o := mqtt.NewClientOptions()
+	o.AddBroker(broker.Address())
+	o.SetMaxReconnectInterval(100 * time.Millisecond)
+	c := NewPahoClient(o)
+	connection := make(chan bool, 10)
+	c.SetConnectionCallback(func(connected bool) { connection <- connected })
+
+	if !c.Connect() {
+		t.Fatalf("Failed to connect to broker")
+	}
+	defer c.Disconnect()
+	<-connection
+
+	// Keep the broker down until the messages are published, so that they are queued
+	broker.Pause()
+	if connected := <-connection; connected {
+		t.Fatalf("Connection loss not reported")
+	}
+	if c.Publish("qos0", 0, false, "lost") {
+		t.Errorf("QoS 0 message should not be queued")
+	}
+	if !c.Publish("qos1", 1, false, "queued") {
+		t.Errorf("QoS 1 message should be queued")
+	}
+	broker.Resume()
+
+	select {
+	case connected := <-connection:
+		if !connected {
+			t.Fatalf("Unexpected connection state")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Connection not restored")
+	}
+
+	var topics []string
+	for _, m := range broker.Messages() {
+		topics = append(topics, m.Topic)
+	}
+	if len(topics) != 1 || topics[0] != "qos1" {
+		t.Errorf("Expected queued message to be published after reconnecting, got %v", topics)
+	}
+}
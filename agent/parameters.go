@@ -2,12 +2,13 @@ package agent
 
 import (
 	"encoding/json"
-
+	"fmt"
+	"reflect"
 	"strconv"
+	"strings"
+	"time"
 
-	"github.com/Knetic/govaluate"
 	log "github.com/Sirupsen/logrus"
-	"github.com/oliveagle/jsonpath"
 )
 
 // Parameter used in MQTT rules; can be updated from incoming MQTT messages
@@ -15,6 +16,31 @@ type Parameter struct {
 	Value      interface{}
 	Topic      string
 	Expression string
+	// Number of recent values kept for aggregates like avg(); values older than HistoryAge
+	// seconds are dropped if given
+	HistorySize int
+	HistoryAge  float64
+
+	// Optional type (see TypeNumber etc.) and constraints; values not matching them are
+	// rejected. Unit describes the value and is removed from string values, e.g. "21.5 °C".
+	Type string
+	Min  *float64
+	Max  *float64
+	Enum []interface{}
+	Unit string
+
+	// The parameter becomes stale if it is not updated within MaxAge seconds. StaleValue, if
+	// given, replaces the value of a stale parameter.
+	MaxAge     float64
+	StaleValue interface{}
+
+	// Publish the value to <prefix>value/<name> when it changes; numeric values only if they
+	// differ from the last published value by at least Deadband
+	Publish  bool
+	Deadband float64
+
+	// Parameters referenced by the expression of a computed parameter
+	dependencies []string
 }
 
 type parameterMap map[string]*Parameter
@@ -28,67 +54,157 @@ func (a *agent) parseParameterValue(value string) interface{} {
 	return value
 }
 
+// parseStructuredValue parses a value like parseParameterValue, but also decodes JSON
+// objects and arrays
+func (a *agent) parseStructuredValue(value string) interface{} {
+	if trimmed := strings.TrimSpace(value); strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+		var v interface{}
+		if err := json.Unmarshal([]byte(trimmed), &v); err == nil {
+			return v
+		}
+	}
+	return a.parseParameterValue(value)
+}
+
 func (a *agent) SetParameterFromString(name string, value string) {
 	if len(name) == 0 {
 		return
 	}
 
-	var p Parameter
-	err := json.Unmarshal([]byte(value), &p)
-	if err != nil {
-		v := a.parseParameterValue(value)
-		a.parameters[name] = &Parameter{v, "", ""}
+	if !isParameterDefinition(value) {
+		v := a.parseStructuredValue(value)
+		a.paramMutex.Lock()
+		if a.parameters[name] != nil {
+			// Keep the definition of an existing parameter; the value is converted to its
+			// type or rejected
+			a.paramMutex.Unlock()
+			a.SetParameterValue(name, v)
+			log.Debugf("Setting value of parameter %s", name)
+			return
+		}
+		a.parameters[name] = &Parameter{Value: v}
+		delete(a.histories, name)
+		a.resetFreshness(name, a.parameters[name])
+		a.paramMutex.Unlock()
 		a.SetParameterValue(name, v)
 		log.Debugf("Setting parameter %s to non-JSON value", name)
 		return
 	}
+	var p Parameter
+	if err := json.Unmarshal([]byte(value), &p); err != nil {
+		log.WithFields(log.Fields{
+			"component": "Parameters",
+			"parameter": name,
+		}).Errorf("Invalid parameter definition: %v", err)
+		return
+	}
 	a.SetParameter(name, p)
 }
 
+// isParameterDefinition reports whether value is a JSON object containing at least one field of
+// Parameter, e.g. {"value": 20, "type": "number"}. Other objects like {"on": true} are values.
+func isParameterDefinition(value string) bool {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(value), &fields); err != nil {
+		return false
+	}
+	t := reflect.TypeOf(Parameter{})
+	for key := range fields {
+		for i := 0; i < t.NumField(); i++ {
+			if f := t.Field(i); f.PkgPath == "" && strings.EqualFold(f.Name, key) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SetParameter defines a parameter. A parameter with an expression, but without topic, is
+// computed from the parameters used in the expression whenever one of them changes.
 func (a *agent) SetParameter(name string, p Parameter) {
+	if err := p.checkType(); err != nil {
+		log.WithFields(log.Fields{
+			"component": "Parameters",
+			"parameter": name,
+		}).Errorf("Invalid parameter type: %v", err)
+		return
+	}
+	if p.isComputed() {
+		if err := a.prepareComputedParameter(name, &p); err != nil {
+			log.WithFields(log.Fields{
+				"component": "Parameters",
+				"parameter": name,
+			}).Errorf("Invalid computed parameter: %v", err)
+			return
+		}
+	}
 	if a.parameters[name] != nil && len(a.parameters[name].Topic) > 0 {
 		a.RemoveParameterSubscription(p.Topic, name)
 	}
 	a.paramMutex.Lock()
 	a.parameters[name] = &p
+	if h := newParameterHistory(p); h != nil {
+		a.histories[name] = h
+	} else {
+		delete(a.histories, name)
+	}
+	a.resetFreshness(name, &p)
 	a.paramMutex.Unlock()
 	a.SetParameterValue(name, p.Value)
+	if p.isComputed() {
+		a.computeParameter(name)
+	}
 	if len(a.parameters[name].Topic) > 0 {
 		a.AddParameterSubscription(p.Topic, name)
 	}
 	log.Debugf("Setting parameter %s to JSON value %+v\n", name, p)
 }
 
+// SetParameterValue sets the value of a parameter, converting it to the type of the parameter.
+// Invalid values are rejected.
 func (a *agent) SetParameterValue(parameter string, value interface{}) {
+	a.setParameterValue(parameter, value, true)
+}
+
+// setParameterValue sets the value of a parameter; fresh is false for values not representing
+// an update, which do not reset the age of the parameter
+func (a *agent) setParameterValue(parameter string, value interface{}, fresh bool) {
 	a.paramMutex.Lock()
+	if p, exists := a.parameters[parameter]; exists {
+		coerced, err := p.coerce(value)
+		if err != nil {
+			a.paramMutex.Unlock()
+			a.rejectParameterValue(parameter, value, err)
+			return
+		}
+		value = coerced
+	}
 	a.parameterValues[parameter] = value
+	if fresh {
+		a.refreshParameter(parameter)
+	}
+	if h, exists := a.histories[parameter]; exists && value != nil {
+		// Parameters without initial value are nil until the first update
+		h.add(time.Now(), value)
+	}
+	p, exists := a.parameters[parameter]
+	publish := exists && a.publishesValue(p) && a.valueChanged(parameter, p, value)
 	a.paramMutex.Unlock()
+	if publish {
+		a.publishValue(parameter, value)
+	}
+	a.updateDependents(parameter)
+	// Condition transitions of state machines may depend on the parameter
+	a.evaluateStateMachineConditions()
 }
 
 func (a *agent) TriggerParameterUpdate(parameter string, value string) {
-	fPayload := func(args ...interface{}) (interface{}, error) {
-		if len(args) == 0 {
-			// No JSON path given - return whole payload.
-			return a.parseParameterValue(value), nil
-		}
-		var jsonData interface{}
-		err := json.Unmarshal([]byte(value), &jsonData)
-		if err != nil {
-			log.Errorf("JSON parsing error in trigger payload when updating parameter %s: %v", parameter, err)
-			return value, err
-		}
-		res, err := jsonpath.JsonPathLookup(jsonData, args[0].(string))
-		if err != nil {
-			log.Errorf("JSON lookup error in trigger payload when updating parameter %s: %v", parameter, err)
-			return value, err
-		}
-
-		return res, nil
-	}
+	a.triggerParameterUpdate(parameter, message{payload: value})
+}
 
-	functions := map[string]govaluate.ExpressionFunction{
-		"payload": fPayload,
-	}
+func (a *agent) triggerParameterUpdate(parameter string, trigger message) {
+	value := trigger.payload
+	functions := a.messageFunctions(trigger, fmt.Sprintf("updating parameter %s", parameter))
 
 	a.paramMutex.Lock()
 	p, exists := a.parameters[parameter]
@@ -99,7 +215,7 @@ func (a *agent) TriggerParameterUpdate(parameter string, value string) {
 
 	if len(p.Expression) == 0 {
 		// directly set value
-		a.SetParameterValue(parameter, value)
+		a.SetParameterValue(parameter, a.parseStructuredValue(value))
 		log.WithFields(log.Fields{
 			"component": "Parameters",
 			"parameter": parameter,
@@ -107,12 +223,12 @@ func (a *agent) TriggerParameterUpdate(parameter string, value string) {
 			"mode":      "fullPayload",
 		}).Debug("Parameter value updated")
 	} else {
-		expression, err := govaluate.NewEvaluableExpressionWithFunctions(p.Expression, functions)
+		expression, err := newExpression(p.Expression, functions)
 		if err != nil {
 			log.Errorln("Error parsing parameter expression :", err)
 			return
 		}
-		result, err := expression.Evaluate(a.parameterValues)
+		result, err := evaluate(expression, a.parameterSnapshot())
 		if err != nil {
 			log.Errorln("Error evaluating parameter expression:", err)
 			return
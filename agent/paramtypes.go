@@ -0,0 +1,157 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Parameter types. Values of typed parameters are converted when they are set; values that
+// cannot be converted or violate the constraints of the parameter are rejected.
+const (
+	TypeNumber  = "number"
+	TypeInteger = "integer"
+	TypeBool    = "bool"
+	TypeString  = "string"
+	TypeJSON    = "json"
+	// Durations like "5m" are stored as number of seconds
+	TypeDuration = "duration"
+)
+
+var parameterTypes = map[string]func(v interface{}) (interface{}, error){
+	TypeNumber: func(v interface{}) (interface{}, error) {
+		return number("number", v)
+	},
+	TypeInteger: func(v interface{}) (interface{}, error) {
+		f, err := number("integer", v)
+		if err != nil {
+			return nil, err
+		}
+		if f != math.Trunc(f) {
+			return nil, fmt.Errorf("%v is not an integer", v)
+		}
+		return f, nil
+	},
+	TypeBool: func(v interface{}) (interface{}, error) {
+		switch v := v.(type) {
+		case bool:
+			return v, nil
+		case float64:
+			if v == 0 || v == 1 {
+				return v == 1, nil
+			}
+		case string:
+			switch strings.ToLower(strings.TrimSpace(v)) {
+			case "true", "on", "yes", "1":
+				return true, nil
+			case "false", "off", "no", "0":
+				return false, nil
+			}
+		}
+		return nil, fmt.Errorf("%v is not a boolean", v)
+	},
+	TypeString: func(v interface{}) (interface{}, error) {
+		return toString(v), nil
+	},
+	TypeJSON: func(v interface{}) (interface{}, error) {
+		s, isString := v.(string)
+		if !isString {
+			return v, nil
+		}
+		var result interface{}
+		if err := json.Unmarshal([]byte(s), &result); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %v", err)
+		}
+		return result, nil
+	},
+	TypeDuration: func(v interface{}) (interface{}, error) {
+		if s, isString := v.(string); isString {
+			if d, err := time.ParseDuration(strings.TrimSpace(s)); err == nil {
+				return d.Seconds(), nil
+			}
+		}
+		seconds, err := number("duration", v)
+		if err != nil {
+			return nil, fmt.Errorf("%v is not a duration", v)
+		}
+		return seconds, nil
+	},
+}
+
+// checkType checks the type and constraints of a parameter definition
+func (p *Parameter) checkType() error {
+	if len(p.Type) > 0 {
+		if _, exists := parameterTypes[p.Type]; !exists {
+			return fmt.Errorf("unknown type '%s'", p.Type)
+		}
+	}
+	if p.Min != nil && p.Max != nil && *p.Min > *p.Max {
+		return fmt.Errorf("minimum %v is greater than maximum %v", *p.Min, *p.Max)
+	}
+	return nil
+}
+
+// coerce converts a value to the type of the parameter and checks its constraints. nil is
+// accepted as "no value".
+func (p *Parameter) coerce(v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	if s, isString := v.(string); isString && len(p.Unit) > 0 {
+		// Accept values including the unit, e.g. "21.5 °C"
+		v = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(s), p.Unit))
+	}
+	if convert, exists := parameterTypes[p.Type]; exists {
+		var err error
+		if v, err = convert(v); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.Min != nil || p.Max != nil {
+		f, err := number("range check", v)
+		if err != nil {
+			return nil, err
+		}
+		if p.Min != nil && f < *p.Min {
+			return nil, fmt.Errorf("%v is less than minimum %v", v, *p.Min)
+		}
+		if p.Max != nil && f > *p.Max {
+			return nil, fmt.Errorf("%v is greater than maximum %v", v, *p.Max)
+		}
+	}
+
+	if len(p.Enum) > 0 {
+		for _, e := range p.Enum {
+			if converted, err := p.convert(e); err == nil && reflect.DeepEqual(converted, v) {
+				return v, nil
+			}
+		}
+		return nil, fmt.Errorf("%v is not one of %v", v, p.Enum)
+	}
+	return v, nil
+}
+
+// convert converts a value to the type of the parameter without checking constraints
+func (p *Parameter) convert(v interface{}) (interface{}, error) {
+	if convert, exists := parameterTypes[p.Type]; exists {
+		return convert(v)
+	}
+	return v, nil
+}
+
+// rejectParameterValue logs and counts a value that does not match the parameter definition
+func (a *agent) rejectParameterValue(parameter string, value interface{}, err error) {
+	atomic.AddUint64(&a.invalidParameterValues, 1)
+	log.WithFields(log.Fields{
+		"component": "Parameters",
+		"parameter": parameter,
+		"value":     value,
+	}).Errorf("Invalid parameter value: %v", err)
+}
@@ -0,0 +1,110 @@
+package agent
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/crenz/mqttrules/test"
+)
+
+func TestParameter_Coerce(t *testing.T) {
+	min, max := 5.0, 30.0
+
+	var tests = []struct {
+		p        Parameter
+		value    interface{}
+		expected interface{}
+		valid    bool
+	}{
+		{Parameter{Type: TypeNumber}, "21.5", 21.5, true},
+		{Parameter{Type: TypeNumber}, "warm", nil, false},
+		{Parameter{Type: TypeNumber, Unit: "°C"}, "21.5 °C", 21.5, true},
+		{Parameter{Type: TypeNumber, Min: &min, Max: &max}, 31.0, nil, false},
+		{Parameter{Type: TypeNumber, Min: &min, Max: &max}, "4", nil, false},
+		{Parameter{Type: TypeInteger}, "3", 3.0, true},
+		{Parameter{Type: TypeInteger}, 3.5, nil, false},
+		{Parameter{Type: TypeBool}, "ON", true, true},
+		{Parameter{Type: TypeBool}, 0.0, false, true},
+		{Parameter{Type: TypeBool}, "maybe", nil, false},
+		{Parameter{Type: TypeString}, 42.0, "42", true},
+		{Parameter{Type: TypeString, Enum: []interface{}{"off", "heat", "cool"}}, "heat", "heat", true},
+		{Parameter{Type: TypeString, Enum: []interface{}{"off", "heat", "cool"}}, "dry", nil, false},
+		{Parameter{Type: TypeInteger, Enum: []interface{}{1.0, 2.0}}, "2", 2.0, true},
+		{Parameter{Type: TypeJSON}, `{"on": true}`, map[string]interface{}{"on": true}, true},
+		{Parameter{Type: TypeJSON}, `{"on": `, nil, false},
+		{Parameter{Type: TypeDuration}, "1m30s", 90.0, true},
+		{Parameter{Type: TypeDuration}, 15.0, 15.0, true},
+		{Parameter{Type: TypeDuration}, "soon", nil, false},
+		{Parameter{}, "anything", "anything", true},
+		{Parameter{Type: TypeNumber}, nil, nil, true},
+	}
+
+	for _, test := range tests {
+		result, err := test.p.coerce(test.value)
+		if (err == nil) != test.valid || !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("coerce(%v) for %+v == %v (%v), want %v", test.value, test.p, result, err, test.expected)
+		}
+	}
+}
+
+func TestAgent_TypedParameters(t *testing.T) {
+	mqttClient := test.NewClient()
+	a := New(mqttClient, "")
+	mqttClient.SetSubscriptionCallback(nil)
+
+	a.SetParameterFromString("setpoint", `{"value": 20, "topic": "heating/setpoint", "type": "number", "min": 5, "max": 30, "unit": "°C"}`)
+	a.HandleMessage("heating/setpoint", []byte("22.5 °C"))
+	if v := a.GetParameterValue("setpoint"); v != 22.5 {
+		t.Errorf("setpoint == %v, want 22.5", v)
+	}
+	a.HandleMessage("heating/setpoint", []byte("45"))
+	if v := a.GetParameterValue("setpoint"); v != 22.5 {
+		t.Errorf("Invalid value should be rejected, setpoint == %v", v)
+	}
+	if n := a.(*agent).invalidParameterValues; n != 1 {
+		t.Errorf("Expected 1 invalid parameter value, got %d", n)
+	}
+
+	// Untyped parameters set from the full payload hold numbers as float64
+	a.SetParameterFromString("level", `{"topic": "sensors/level"}`)
+	a.TriggerParameterUpdate("level", "42")
+	if v := a.GetParameterValue("level"); v != 42.0 {
+		t.Errorf("level == %#v, want 42.0", v)
+	}
+
+	a.SetParameterFromString("mode", `{"value": "off", "type": "color"}`)
+	if v := a.GetParameterValue("mode"); v != "" {
+		t.Errorf("Parameter with unknown type should be rejected, got %v", v)
+	}
+}
+
+func TestAgent_TypedParameterFromString(t *testing.T) {
+	mqttClient := test.NewClient()
+	a := New(mqttClient, "")
+	mqttClient.SetSubscriptionCallback(nil)
+
+	a.SetParameterFromString("brightness", `{"value": 10, "type": "integer", "min": 0}`)
+
+	// Plain values keep the definition and are converted or rejected
+	var tests = []struct {
+		value    string
+		expected interface{}
+	}{
+		{"20", 20.0},
+		{"banana", 20.0},
+		{"-3", 20.0},
+		{"2.5", 20.0},
+		{"0", 0.0},
+	}
+	for _, test := range tests {
+		a.SetParameterFromString("brightness", test.value)
+		if v := a.GetParameterValue("brightness"); v != test.expected {
+			t.Errorf("After %q, brightness == %#v, want %#v", test.value, v, test.expected)
+		}
+	}
+
+	p := a.(*agent).parameters["brightness"]
+	if p.Type != TypeInteger || p.Min == nil || *p.Min != 0 {
+		t.Errorf("Definition of brightness was replaced: %+v", p)
+	}
+}
@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	"github.com/Knetic/govaluate"
+	log "github.com/Sirupsen/logrus"
+)
+
+// regexExpression matches ${...} expressions in strings
+var regexExpression = regexp.MustCompile("[$][{].*?[}]")
+
+// actionPayload evaluates the payload of an action for the trigger t
+func (a *agent) actionPayload(action Action, t Trigger, functions map[string]govaluate.ExpressionFunction) string {
+	if action.Template {
+		s, err := a.renderTemplate(action.payloadTemplate, t, functions)
+		if err != nil {
+			log.Errorf("Error rendering payload template for [%s]: %v", action.Topic, err)
+			return ""
+		}
+		return s
+	}
+	if action.PayloadJSON != nil {
+		b, err := json.Marshal(a.evalJSON(action.PayloadJSON, functions))
+		if err != nil {
+			log.Errorf("Error encoding JSON payload for [%s]: %v", action.Topic, err)
+			return ""
+		}
+		return string(b)
+	}
+	return a.EvalExpressionsInString(action.Payload, functions)
+}
+
+// actionTopic evaluates the topic of an action for the trigger t and checks that it can be
+// published to
+func (a *agent) actionTopic(action Action, t Trigger, functions map[string]govaluate.ExpressionFunction) (string, error) {
+	var topic string
+	if action.Template {
+		s, err := a.renderTemplate(action.topicTemplate, t, functions)
+		if err != nil {
+			return "", fmt.Errorf("error rendering topic template '%s': %v", action.Topic, err)
+		}
+		topic = s
+	} else {
+		topic = a.EvalExpressionsInString(action.Topic, functions)
+	}
+	if err := validatePublishTopic(topic); err != nil {
+		return "", fmt.Errorf("invalid topic from '%s': %v", action.Topic, err)
+	}
+	return topic, nil
+}
+
+// evalJSON evaluates the expressions in the string values of a JSON document
+func (a *agent) evalJSON(v interface{}, functions map[string]govaluate.ExpressionFunction) interface{} {
+	switch v := v.(type) {
+	case string:
+		if loc := regexExpression.FindAllStringIndex(v, -1); len(loc) == 1 && loc[0][0] == 0 && loc[0][1] == len(v) {
+			result, err := a.evaluateExpression(v[2:len(v)-1], functions)
+			if err != nil {
+				log.Errorf("Error in expression %s: %v", v, err)
+				return nil
+			}
+			return result
+		}
+		return a.EvalExpressionsInString(v, functions)
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			out[key] = a.evalJSON(value, functions)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, value := range v {
+			out[i] = a.evalJSON(value, functions)
+		}
+		return out
+	}
+	return v
+}
@@ -0,0 +1,69 @@
+package agent
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/crenz/mqttrules/test"
+	"github.com/davecgh/go-spew/spew"
+)
+
+func TestAgent_PayloadJSON(t *testing.T) {
+	mqttClient := test.NewClient()
+	a := New(mqttClient, "")
+	mqttClient.SetSubscriptionCallback(nil)
+	a.SetParameterFromString("room", "Living \"room\"")
+
+	expected := map[string]interface{}{
+		"brightness": 42.0,
+		"on":         true,
+		"label":      `Living "room"`,
+		"text":       `Living "room" at 42%`,
+		"fixed":      1.5,
+		"missing":    nil,
+		"state": map[string]interface{}{
+			"values": []interface{}{42.0, "static", false},
+		},
+	}
+
+	for format, rule := range map[string]string{
+		FormatJSON: `{"actions": [{"topic": "lights/set", "payloadJSON": {
+			"brightness": "${payload('$.level')}",
+			"on": "${payload('$.level') > 0}",
+			"label": "${room}",
+			"text": "${room} at ${payload('$.level')}%",
+			"fixed": 1.5,
+			"missing": null,
+			"state": {"values": ["${payload('$.level')}", "static", false]}
+		}}]}`,
+		FormatYAML: `
+actions:
+  - topic: lights/set
+    payloadJSON:
+      brightness: ${payload('$.level')}
+      "on": ${payload('$.level') > 0}
+      label: ${room}
+      text: ${room} at ${payload('$.level')}%
+      fixed: 1.5
+      missing: null
+      state:
+        values: ["${payload('$.level')}", static, false]
+`,
+	} {
+		a.AddRuleFromFormattedString("lights", format, format, rule)
+		a.ExecuteRule("lights", format, `{"level": 42}`)
+
+		m := mqttClient.LastMessage()
+		var payload map[string]interface{}
+		if err := json.Unmarshal([]byte(m.Payload.(string)), &payload); err != nil {
+			t.Errorf("Invalid JSON payload (%s rule): %v", format, err)
+			spew.Dump(m)
+			continue
+		}
+		if !reflect.DeepEqual(payload, expected) {
+			t.Errorf("Unexpected JSON payload (%s rule)", format)
+			spew.Dump(payload)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package agent
+
+import (
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// DefaultQueueSize is the number of outbound messages buffered while the broker is unreachable
+const DefaultQueueSize = 1000
+
+type queuedMessage struct {
+	topic      string
+	qos        byte
+	retained   bool
+	payload    interface{}
+	properties *MessageProperties
+}
+
+// publishQueue buffers outbound messages while the connection to the broker is down. When
+// the queue is full, the oldest message is dropped.
+type publishQueue struct {
+	mutex    sync.Mutex
+	messages []queuedMessage
+	size     int
+}
+
+func newPublishQueue(size int) *publishQueue {
+	if size <= 0 {
+		size = DefaultQueueSize
+	}
+	return &publishQueue{size: size}
+}
+
+// push queues a message for later delivery. QoS 0 messages are not retried and therefore
+// not queued; push returns false for them.
+func (q *publishQueue) push(m queuedMessage) bool {
+	if m.qos == 0 {
+		return false
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.messages) >= q.size {
+		log.WithFields(log.Fields{
+			"component": "PublishQueue",
+			"topic":     q.messages[0].topic,
+		}).Warn("Outbound queue full, dropping oldest message")
+		q.messages = q.messages[1:]
+	}
+	q.messages = append(q.messages, m)
+	return true
+}
+
+// requeue puts messages back at the front of the queue, e.g. after a failed replay
+func (q *publishQueue) requeue(messages []queuedMessage) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.messages = append(messages, q.messages...)
+	if len(q.messages) > q.size {
+		q.messages = q.messages[len(q.messages)-q.size:]
+	}
+}
+
+// take removes and returns all queued messages
+func (q *publishQueue) take() []queuedMessage {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	messages := q.messages
+	q.messages = nil
+	return messages
+}
+
+func (q *publishQueue) len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.messages)
+}
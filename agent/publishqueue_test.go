@@ -0,0 +1,33 @@
+package agent
+
+import (
+	"testing"
+)
+
+func TestPublishQueue(t *testing.T) {
+	q := newPublishQueue(2)
+
+	if q.push(queuedMessage{"qos0", 0, false, "", nil}) {
+		t.Errorf("QoS 0 message should not have been queued")
+	}
+	for _, topic := range []string{"a", "b", "c"} {
+		if !q.push(queuedMessage{topic, 1, false, "", nil}) {
+			t.Errorf("Message %s should have been queued", topic)
+		}
+	}
+	if q.len() != 2 {
+		t.Errorf("Queue length == %d, want 2", q.len())
+	}
+
+	messages := q.take()
+	if len(messages) != 2 || messages[0].topic != "b" || messages[1].topic != "c" || q.len() != 0 {
+		t.Errorf("Oldest message should have been dropped, got %+v", messages)
+	}
+
+	q.push(queuedMessage{"d", 2, false, "", nil})
+	q.requeue(messages)
+	messages = q.take()
+	if len(messages) != 2 || messages[0].topic != "c" || messages[1].topic != "d" {
+		t.Errorf("Requeued messages not in correct order, got %+v", messages)
+	}
+}
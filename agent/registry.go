@@ -0,0 +1,93 @@
+package agent
+
+import (
+	"github.com/Knetic/govaluate"
+)
+
+// Trigger describes the message that triggered a rule execution or parameter update. It is
+// empty for scheduled rule executions.
+type Trigger struct {
+	Topic      string
+	Payload    string
+	Properties *MessageProperties
+	// Topic levels matched by the wildcards + and # of the trigger, e.g. ["kitchen"] for
+	// topic home/kitchen/motion and trigger home/+/motion
+	Wildcards []string
+	// Messages matched by a sequence trigger, oldest first
+	Events []Trigger
+
+	// Operation for error messages, e.g. "executing rule lights/kitchen"
+	context string
+}
+
+// FunctionFactory creates an expression function for a rule execution or parameter update.
+// Functions that do not depend on the trigger can be registered with RegisterFunction.
+type FunctionFactory func(a Agent, t Trigger) govaluate.ExpressionFunction
+
+// ActionExecutor performs actions of a custom type. functions holds the expression functions
+// of the current rule execution, e.g. for use with Agent.EvalExpressionsInString.
+type ActionExecutor func(a Agent, action Action, t Trigger, functions map[string]govaluate.ExpressionFunction) error
+
+// ActionPublish is the type of actions sending an MQTT message, used if an action has no type
+const ActionPublish = "publish"
+
+// Registry holds the expression functions and action types available to rules and
+// parameters. Register custom functions and actions before passing the registry to New;
+// registering an existing name replaces the built-in implementation.
+type Registry struct {
+	functions map[string]FunctionFactory
+	actions   map[string]ActionExecutor
+}
+
+// NewRegistry creates a registry containing the built-in functions and actions
+func NewRegistry() *Registry {
+	r := &Registry{
+		functions: make(map[string]FunctionFactory),
+		actions:   make(map[string]ActionExecutor),
+	}
+	registerMessageFunctions(r)
+	registerStandardFunctions(r)
+	registerHistoryFunctions(r)
+	registerStalenessFunctions(r)
+	registerSequenceFunctions(r)
+	r.RegisterAction(ActionPublish, executePublish)
+	r.RegisterAction(ActionScene, executeSceneAction)
+	return r
+}
+
+// RegisterFunction adds an expression function that does not depend on the trigger
+func (r *Registry) RegisterFunction(name string, f govaluate.ExpressionFunction) {
+	r.functions[name] = func(Agent, Trigger) govaluate.ExpressionFunction {
+		return f
+	}
+}
+
+// RegisterFunctionFactory adds an expression function created for each rule execution or
+// parameter update
+func (r *Registry) RegisterFunctionFactory(name string, f FunctionFactory) {
+	r.functions[name] = f
+}
+
+// RegisterAction adds an action type, used by actions setting "type" to actionType
+func (r *Registry) RegisterAction(actionType string, e ActionExecutor) {
+	r.actions[actionType] = e
+}
+
+// expressionFunctions creates the expression functions for a rule execution or parameter
+// update
+func (r *Registry) expressionFunctions(a Agent, t Trigger) map[string]govaluate.ExpressionFunction {
+	functions := make(map[string]govaluate.ExpressionFunction, len(r.functions))
+	for name, f := range r.functions {
+		functions[name] = f(a, t)
+	}
+	return functions
+}
+
+// action returns the executor for an action type
+func (r *Registry) action(actionType string) (ActionExecutor, bool) {
+	if len(actionType) == 0 {
+		actionType = ActionPublish
+	}
+	e, exists := r.actions[actionType]
+	return e, exists
+}
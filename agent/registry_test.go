@@ -0,0 +1,55 @@
+package agent
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/Knetic/govaluate"
+	"github.com/crenz/mqttrules/test"
+	"github.com/davecgh/go-spew/spew"
+)
+
+func TestRegistry(t *testing.T) {
+	var notified []string
+
+	registry := NewRegistry()
+	registry.RegisterFunction("double", func(args ...interface{}) (interface{}, error) {
+		return args[0].(float64) * 2, nil
+	})
+	registry.RegisterFunctionFactory("triggerTopic", func(a Agent, t Trigger) govaluate.ExpressionFunction {
+		return func(args ...interface{}) (interface{}, error) {
+			return t.Topic, nil
+		}
+	})
+	registry.RegisterAction("notify", func(a Agent, action Action, t Trigger, functions map[string]govaluate.ExpressionFunction) error {
+		notified = append(notified, fmt.Sprintf("%v: %s", action.Options["channel"], a.EvalExpressionsInString(action.Payload, functions)))
+		return nil
+	})
+
+	mqttClient := test.NewClient()
+	a := New(mqttClient, "", registry)
+	mqttClient.SetSubscriptionCallback(nil)
+
+	a.AddRuleFromString("custom", "rule", `{"trigger": "sensors/temperature", "condition": "double(payload()) > 40", "actions": [
+		{"type": "notify", "options": {"channel": "phone"}, "payload": "${triggerTopic()} is ${payload()}"},
+		{"topic": "sensors/doubled", "payload": "${double(payload())}"}
+	]}`)
+	a.HandleMessage("sensors/temperature", []byte("21"))
+
+	if len(notified) != 1 || notified[0] != "phone: sensors/temperature is 21" {
+		t.Errorf("Custom action not executed correctly: %v", notified)
+	}
+	if m := mqttClient.LastMessage(); m.Topic != "sensors/doubled" || m.Payload != "42" {
+		t.Errorf("Custom function not available in built-in action")
+		spew.Dump(m)
+	}
+
+	a.AddRuleFromString("custom", "unknown", `{"actions": [{"type": "email"}]}`)
+	if a.GetRule("custom", "unknown") != nil {
+		t.Errorf("Rule with unknown action type should not be added")
+	}
+
+	if _, ok := New(test.NewClient(), "").(*agent).messageFunctions(message{}, "")["double"]; ok {
+		t.Errorf("Custom functions should only be available to agents using the registry")
+	}
+}
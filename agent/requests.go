@@ -0,0 +1,136 @@
+package agent
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Knetic/govaluate"
+	log "github.com/Sirupsen/logrus"
+	"github.com/oliveagle/jsonpath"
+)
+
+// DefaultRequestTimeout is used for request actions that do not specify a timeout
+const DefaultRequestTimeout = 5 * time.Second
+
+var errRequestTimeout = errors.New("no response received")
+
+// pendingRequest is a request action waiting for its response
+type pendingRequest struct {
+	replyTopic      string
+	correlationData string
+	correlationPath string
+	response        chan message
+}
+
+// matches checks whether m is the response to the request. Responses are correlated by the
+// value at correlationPath in the JSON payload if given, else by MQTT 5 correlation data.
+func (r *pendingRequest) matches(m message) bool {
+	if m.topic != r.replyTopic {
+		return false
+	}
+	if len(r.correlationPath) > 0 {
+		var data interface{}
+		if err := json.Unmarshal([]byte(m.payload), &data); err != nil {
+			return false
+		}
+		id, err := jsonpath.JsonPathLookup(data, r.correlationPath)
+		return err == nil && fmt.Sprintf("%v", id) == r.correlationData
+	}
+	return m.properties != nil && m.properties.CorrelationData == r.correlationData
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// deliverResponse hands m to the pending request it answers. It is called by the MQTT client
+// callbacks, as the rule waiting for the response blocks the Listen loop.
+func (a *agent) deliverResponse(m message) {
+	a.requestsMutex.Lock()
+	defer a.requestsMutex.Unlock()
+	for r := range a.requests {
+		if r.matches(m) {
+			delete(a.requests, r)
+			r.response <- m
+		}
+	}
+}
+
+// hasPendingRequests returns true while a rule is waiting for a response
+func (a *agent) hasPendingRequests() bool {
+	a.requestsMutex.Lock()
+	defer a.requestsMutex.Unlock()
+	return len(a.requests) > 0
+}
+
+// request publishes a request action to topic and waits for the response. It returns false if no
+// response was received within the timeout.
+func (a *agent) request(action Action, topic string, t Trigger, functions map[string]govaluate.ExpressionFunction) (message, bool) {
+	id := newRequestID()
+	functions["requestId"] = func(args ...interface{}) (interface{}, error) {
+		return id, nil
+	}
+
+	properties := a.actionProperties(action, functions)
+	if properties == nil {
+		properties = &MessageProperties{}
+	}
+	if len(properties.CorrelationData) == 0 {
+		properties.CorrelationData = id
+	}
+	replyTopic := a.EvalExpressionsInString(action.ReplyTopic, functions)
+	if len(properties.ResponseTopic) == 0 {
+		properties.ResponseTopic = replyTopic
+	}
+
+	r := &pendingRequest{
+		replyTopic:      replyTopic,
+		correlationData: properties.CorrelationData,
+		correlationPath: action.CorrelationPath,
+		response:        make(chan message, 1),
+	}
+
+	if _, subscribed := a.subscriptions[replyTopic]; !subscribed {
+		if !a.mqttClient.Subscribe(replyTopic, 1) {
+			log.Errorf("Failed to subscribe to reply topic [%s]", replyTopic)
+		}
+		defer a.mqttClient.Unsubscribe(replyTopic)
+	}
+
+	a.requestsMutex.Lock()
+	a.requests[r] = true
+	a.requestsMutex.Unlock()
+
+	timeout := DefaultRequestTimeout
+	if action.Timeout > 0 {
+		timeout = time.Duration(action.Timeout * float64(time.Second))
+	}
+	a.publishWithProperties(topic, action.QoS, action.Retain, a.actionPayload(action, t, functions), properties)
+
+	select {
+	case m := <-r.response:
+		return m, true
+	case <-time.After(timeout):
+		a.requestsMutex.Lock()
+		delete(a.requests, r)
+		a.requestsMutex.Unlock()
+		log.WithFields(log.Fields{
+			"component": "Rules",
+			"topic":     topic,
+			"reply":     replyTopic,
+		}).Warn("No response received for request")
+		return message{}, false
+	}
+}
+
+// responseFunction returns the response() expression function giving access to the payload
+// of the response m. Like payload(), it takes an optional JSON path.
+func (a *agent) responseFunction(m message) govaluate.ExpressionFunction {
+	return a.messageFunctions(m, "evaluating response to "+m.topic)["payload"]
+}
@@ -0,0 +1,99 @@
+package agent
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+
+	"github.com/crenz/mqttrules/test"
+	"github.com/davecgh/go-spew/spew"
+)
+
+func TestAgent_RequestResponse(t *testing.T) {
+	mqttClient := test.NewClient()
+	a := New(mqttClient, "").(*agent)
+	// Act as the device answering commands on device/reply
+	mqttClient.SetSubscriptionCallback(func(topic string, payload string) {
+		if topic != "device/command" {
+			return
+		}
+		var request map[string]interface{}
+		json.Unmarshal([]byte(payload), &request)
+		a.messagehandler("device/reply", `{"id": "other", "value": 0}`)
+		a.messagehandler("device/reply", `{"id": "`+request["id"].(string)+`", "value": 21}`)
+	})
+
+	a.AddRuleFromString("device", "query", `{"actions": [
+		{"topic": "device/command", "payload": "{\"id\": \"${requestId()}\"}",
+		 "replyTopic": "device/reply", "correlationPath": "$.id", "timeout": 1,
+		 "onTimeout": [{"topic": "device/result", "payload": "timeout"}]},
+		{"topic": "device/result", "payload": "${response('$.value') * 2}"}
+	]}`)
+	a.ExecuteRule("device", "query", "")
+	if m := mqttClient.LastMessage(); m.Topic != "device/result" || m.Payload != "42" {
+		t.Errorf("Response not available to subsequent action")
+		spew.Dump(m)
+	}
+	if mqttClient.IsSubscribed("device/reply") || a.hasPendingRequests() {
+		t.Errorf("Request not cleaned up after response")
+	}
+}
+
+func TestAgent_RequestCorrelationData(t *testing.T) {
+	mqttClient := test.NewClient()
+	a := New(mqttClient, "").(*agent)
+	mqttClient.SetSubscriptionCallback(func(topic string, payload string) {
+		if topic == "device/command" {
+			a.propertiesMessageHandler("device/reply", "wrong", &MessageProperties{CorrelationData: "other"})
+			a.propertiesMessageHandler("device/reply", "on", &MessageProperties{CorrelationData: "cmd-1"})
+		}
+	})
+
+	a.AddRuleFromString("device", "query", `{"actions": [
+		{"topic": "device/command", "payload": "state", "replyTopic": "device/reply",
+		 "correlationData": "cmd-1", "timeout": 1},
+		{"topic": "device/result", "payload": "${response()}"}
+	]}`)
+	a.ExecuteRule("device", "query", "")
+	if m := mqttClient.LastMessage(); m.Topic != "device/result" || m.Payload != "on" {
+		t.Errorf("Response not correlated by correlation data")
+		spew.Dump(m)
+	}
+}
+
+func TestAgent_RequestTimeout(t *testing.T) {
+	mqttClient := test.NewClient()
+	a := New(mqttClient, "").(*agent)
+	mqttClient.SetSubscriptionCallback(nil)
+
+	a.AddRuleFromString("device", "query", `{"actions": [
+		{"topic": "device/command", "payload": "state", "replyTopic": "device/reply", "timeout": 0.05,
+		 "onTimeout": [{"topic": "device/error", "payload": "timeout"}]},
+		{"topic": "device/result", "payload": "${response()}"}
+	]}`)
+	a.ExecuteRule("device", "query", "")
+	if m := mqttClient.LastMessage(); m.Topic != "device/error" || m.Payload != "timeout" {
+		t.Errorf("Timeout actions not executed")
+		spew.Dump(m)
+	}
+	if a.hasPendingRequests() {
+		t.Errorf("Request not removed after timeout")
+	}
+}
+
+func TestAgent_RequestOverflowOrder(t *testing.T) {
+	mqttClient := test.NewClient()
+	a := New(mqttClient, "").(*agent)
+	mqttClient.SetSubscriptionCallback(nil)
+	a.requests[&pendingRequest{}] = true
+
+	n := incomingBufferSize + 50
+	for i := 0; i < n; i++ {
+		a.messagehandler("sensors/count", strconv.Itoa(i))
+	}
+	for i := 0; i < n; i++ {
+		if m := <-a.incoming; m.payload != strconv.Itoa(i) {
+			t.Fatalf("Message %d received out of order: %s", i, m.payload)
+		}
+	}
+}
@@ -1,31 +1,81 @@
 package agent
 
 import (
-	"encoding/json"
-
 	"fmt"
-	"regexp"
+	"text/template"
 
 	"github.com/Knetic/govaluate"
 	log "github.com/Sirupsen/logrus"
-	"github.com/oliveagle/jsonpath"
 	"github.com/robfig/cron"
+	"github.com/yuin/gopher-lua"
 )
 
 type Action struct {
+	// Action type registered in the Registry; defaults to publishing a message
+	Type string
+	// Settings for custom action types
+	Options map[string]interface{}
+
+	// Topic and Payload may contain ${...} expressions
 	Topic   string
 	Payload string
-	QoS     byte
-	Retain  bool
+	// Render Topic and Payload as Go text/template instead of evaluating ${...} expressions
+	Template        bool
+	topicTemplate   *template.Template
+	payloadTemplate *template.Template
+	// JSON payload given as a structured value, used instead of Payload. String values may
+	// contain ${...} expressions; a value consisting of a single expression keeps the type of
+	// its result.
+	PayloadJSON interface{}
+	QoS         byte
+	Retain      bool
+
+	// MQTT 5 properties, only sent when using the MQTT 5 client. Except for MessageExpiry,
+	// they may contain ${...} expressions.
+	ContentType     string
+	ResponseTopic   string
+	CorrelationData string
+	UserProperties  map[string]string
+	MessageExpiry   uint32
+
+	// Request/response: if ReplyTopic is set, the action waits for a response on ReplyTopic
+	// before the next action is executed. Responses are correlated by the value at the JSON
+	// path CorrelationPath in the response payload, or by MQTT 5 correlation data if no path
+	// is given; both default to the generated requestId(). If no response arrives within
+	// Timeout seconds, the OnTimeout actions are executed instead of the remaining actions.
+	ReplyTopic      string
+	CorrelationPath string
+	Timeout         float64
+	OnTimeout       []Action
+
+	// Branching: the action is only performed if Condition evaluates to true, else the Else
+	// actions are executed. Actions are performed before the message of this action is sent,
+	// so an action without topic groups several actions under one condition.
+	Condition string
+	Actions   []Action
+	Else      []Action
+
+	// Lua script executed when the action is performed, before its message is sent
+	Script string
+	script *lua.FunctionProto
 }
 
 type Rule struct {
-	Trigger             string
-	Schedule            string
-	Condition           string
-	Actions             []Action
+	Trigger string
+	// Ordered events within a time window triggering the rule, used instead of Trigger
+	Sequence  *Sequence
+	Schedule  string
+	Condition string
+	Actions   []Action
+	// Lua script that needs to return true for the actions to be executed, evaluated after
+	// Condition
+	ConditionScript string
+	// Actions executed if Condition or ConditionScript evaluate to false
+	Else                []Action
 	conditionExpression *govaluate.EvaluableExpression
+	conditionScript     *lua.FunctionProto
 	cron                *cron.Cron
+	sequence            *sequenceState
 }
 
 func (a *agent) GetRule(ruleset string, rule string) *Rule {
@@ -40,12 +90,24 @@ func (a *agent) GetRule(ruleset string, rule string) *Rule {
 }
 
 func (a *agent) AddRuleFromString(ruleset string, rule string, value string) {
-	log.Debugf("Received rule '%s/%s'", ruleset, rule)
+	a.AddRuleFromFormattedString(ruleset, rule, FormatJSON, value)
+}
+
+func (a *agent) AddRuleFromFormattedString(ruleset string, rule string, format string, value string) {
+	log.Debugf("Received rule '%s/%s' (%s)", ruleset, rule, format)
+
+	// A definition naming a template creates an instance of it
+	var i RuleInstance
+	if err := unmarshalFormat([]byte(value), format, &i); err == nil && len(i.Template) > 0 {
+		i.Ruleset, i.Rule = ruleset, rule
+		a.AddInstance(i)
+		return
+	}
 
 	var r Rule
-	err := json.Unmarshal([]byte(value), &r)
+	err := unmarshalFormat([]byte(value), format, &r)
 	if err != nil {
-		log.Errorf("[Rule] Unable to parse JSON string: %v", err)
+		log.Errorf("[Rule] Unable to parse %s string: %v", format, err)
 		return
 	}
 
@@ -55,11 +117,9 @@ func (a *agent) AddRuleFromString(ruleset string, rule string, value string) {
 func (a *agent) AddRule(ruleset string, rule string, r Rule) {
 	var err error
 
-	functions := map[string]govaluate.ExpressionFunction{
-		"payload": func(args ...interface{}) (interface{}, error) { return nil, nil },
-	}
+	functions := a.messageFunctions(message{}, "")
 
-	if len(r.Actions) == 0 {
+	if len(r.Actions) == 0 && len(r.Else) == 0 {
 		log.Errorf("Failed to add Rule that does not contain any actions")
 		return
 	}
@@ -72,13 +132,34 @@ func (a *agent) AddRule(ruleset string, rule string, r Rule) {
 	}
 
 	if len(r.Condition) > 0 {
-		r.conditionExpression, err = govaluate.NewEvaluableExpressionWithFunctions(r.Condition, functions)
+		r.conditionExpression, err = newExpression(r.Condition, functions)
 		if err != nil {
 			log.Errorf("Error parsing rule condition: %v", err)
 			return
 		}
 	}
 
+	if len(r.ConditionScript) > 0 {
+		r.conditionScript, err = compileScript(r.ConditionScript, fmt.Sprintf("%s/%s condition", ruleset, rule))
+		if err != nil {
+			log.Errorf("Error parsing rule condition script: %v", err)
+			return
+		}
+	}
+	if r.Sequence != nil {
+		if err = a.checkSequence(r.Sequence); err != nil {
+			log.Errorf("Invalid sequence trigger: %v", err)
+			return
+		}
+		r.sequence = &sequenceState{}
+	}
+	for _, actions := range [][]Action{r.Actions, r.Else} {
+		if err = a.prepareActions(actions, fmt.Sprintf("%s/%s action", ruleset, rule)); err != nil {
+			log.Errorf("Invalid action: %v", err)
+			return
+		}
+	}
+
 	rk := rulesKey{ruleset, rule}
 
 	if prevR := a.GetRule(ruleset, rule); prevR != nil {
@@ -88,6 +169,12 @@ func (a *agent) AddRule(ruleset string, rule string, r Rule) {
 		if prevR.cron != nil {
 			prevR.cron.Stop()
 		}
+		if prevR.Sequence != nil {
+			prevR.sequence.mutex.Lock()
+			prevR.sequence.reset()
+			prevR.sequence.mutex.Unlock()
+			a.removeSequenceSubscriptions(ruleset, rule, prevR.Sequence)
+		}
 	}
 
 	a.rulesMutex.Lock()
@@ -97,6 +184,9 @@ func (a *agent) AddRule(ruleset string, rule string, r Rule) {
 	if len(r.Trigger) > 0 {
 		a.AddRuleSubscription(r.Trigger, ruleset, rule)
 	}
+	if r.Sequence != nil {
+		a.addSequenceSubscriptions(ruleset, rule, r.Sequence)
+	}
 	if r.cron != nil {
 		r.cron.Start()
 	}
@@ -127,85 +217,225 @@ func (a *agent) RemoveRuleSubscription(topic string, ruleset string, rule string
 }
 
 func (a *agent) ExecuteRule(ruleset string, rule string, triggerPayload string) {
+	a.executeRule(ruleset, rule, message{payload: triggerPayload})
+}
+
+func (a *agent) executeRule(ruleset string, rule string, trigger message) {
 	log.WithFields(log.Fields{
 		"component": "Rules",
 		"ruleset":   ruleset,
 		"rule":      rule,
 	}).Debug("Incoming rule execution request")
 
-	fPayload := func(args ...interface{}) (interface{}, error) {
-		if len(args) == 0 {
-			// No JSON path given - return whole payload
-			return a.parseParameterValue(triggerPayload), nil
-		}
-		var jsonData interface{}
-		err := json.Unmarshal([]byte(triggerPayload), &jsonData)
-		if err != nil {
-			log.Errorf("JSON parsing error in trigger payload when executing rule %s/%s: %v", ruleset, rule, err)
-			return triggerPayload, err
-		}
-		res, err := jsonpath.JsonPathLookup(jsonData, args[0].(string))
-		if err != nil {
-			log.Errorf("JSON lookup error in trigger payload when executing rule %s/%s: %v", ruleset, rule, err)
-			return triggerPayload, err
-		}
-
-		return res, nil
-	}
-
-	functions := map[string]govaluate.ExpressionFunction{
-		"payload": fPayload,
-	}
+	functions := a.messageFunctions(trigger, fmt.Sprintf("executing rule %s/%s", ruleset, rule))
 
 	r := a.GetRule(ruleset, rule)
 	if r == nil {
 		return
 	}
-	if len(r.Condition) > 0 {
-		expression, err := govaluate.NewEvaluableExpressionWithFunctions(r.Condition, functions)
+	result, ok := a.evaluateCondition(r.Condition, functions)
+	if ok && result && r.conditionScript != nil {
+		value, err := a.runScript(r.conditionScript, trigger)
 		if err != nil {
-			log.Errorln("Error parsing condition:", err)
+			log.Errorln("Error evaluating condition script:", err)
 			return
 		}
-		result, err := expression.Evaluate(a.parameterValues)
-		if err != nil {
-			log.Errorln("Error evaluating condition:", err)
-			return
-		}
-		if result != true {
+		result = lua.LVAsBool(value)
+	}
+	if !ok {
+		return
+	} else if !result {
+		if len(r.Else) == 0 {
 			log.Debugln("Condition evaluated to false, rule not executed")
 			return
 		}
+		log.Debugln("Condition evaluated to false, executing else actions")
+		a.executeActions(r.Else, functions, trigger)
+		return
 	}
-	for _, r := range r.Actions {
-		s := a.EvalExpressionsInString(r.Payload, functions)
-		a.Publish(r.Topic, r.QoS, r.Retain, s)
+	a.executeActions(r.Actions, functions, trigger)
+}
+
+// evaluateCondition evaluates a rule or action condition; an empty condition is true. ok is
+// false if the condition cannot be evaluated.
+func (a *agent) evaluateCondition(condition string, functions map[string]govaluate.ExpressionFunction) (result bool, ok bool) {
+	if len(condition) == 0 {
+		return true, true
 	}
+	expression, err := newExpression(condition, functions)
+	if err != nil {
+		log.Errorln("Error parsing condition:", err)
+		return false, false
+	}
+	value, err := evaluate(expression, a.parameterSnapshot())
+	if err != nil {
+		log.Errorln("Error evaluating condition:", err)
+		return false, false
+	}
+	return value == true, true
+}
+
+// executeActions performs a list of actions. The response to a request action is available
+// to the following actions via response(). It returns false if a request timed out, in which
+// case the remaining actions of the rule are skipped.
+func (a *agent) executeActions(actions []Action, functions map[string]govaluate.ExpressionFunction, trigger message) bool {
+	for _, r := range actions {
+		if result, ok := a.evaluateCondition(r.Condition, functions); !ok {
+			continue
+		} else if !result {
+			if !a.executeActions(r.Else, functions, trigger) {
+				return false
+			}
+			continue
+		}
+		if !a.executeActions(r.Actions, functions, trigger) {
+			return false
+		}
+		if r.script != nil {
+			if _, err := a.runScript(r.script, trigger); err != nil {
+				log.Errorln("Error executing action script:", err)
+			}
+		}
+		execute, _ := a.registry.action(r.Type)
+		if err := execute(a, r, trigger.trigger(""), functions); err == errRequestTimeout {
+			a.executeActions(r.OnTimeout, functions, trigger)
+			return false
+		} else if err != nil {
+			log.WithFields(log.Fields{
+				"component": "Rules",
+				"type":      r.Type,
+			}).Errorf("Error executing action: %v", err)
+		}
+	}
+	return true
+}
+
+// prepareActions compiles the scripts of actions, including nested actions, and checks that
+// their types are registered
+func (a *agent) prepareActions(actions []Action, name string) error {
+	for i := range actions {
+		if _, exists := a.registry.action(actions[i].Type); !exists {
+			return fmt.Errorf("unknown action type '%s'", actions[i].Type)
+		}
+		if actions[i].Template {
+			var err error
+			if actions[i].topicTemplate, err = a.parseTemplate(name+" topic", actions[i].Topic); err != nil {
+				return err
+			}
+			if actions[i].payloadTemplate, err = a.parseTemplate(name+" payload", actions[i].Payload); err != nil {
+				return err
+			}
+		}
+		if len(actions[i].ReplyTopic) > 0 && len(actions[i].CorrelationPath) == 0 {
+			if _, ok := a.mqttClient.(PropertiesClient); !ok {
+				log.WithFields(log.Fields{
+					"component": "Rules",
+					"action":    name,
+					"reply":     actions[i].ReplyTopic,
+				}).Warn("Request without correlationPath needs MQTT 5 to match responses")
+			}
+		}
+		if len(actions[i].Script) > 0 {
+			script, err := compileScript(actions[i].Script, name)
+			if err != nil {
+				return err
+			}
+			actions[i].script = script
+		}
+		for _, nested := range [][]Action{actions[i].Actions, actions[i].Else, actions[i].OnTimeout} {
+			if err := a.prepareActions(nested, name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// executePublish performs actions sending an MQTT message. Request actions wait for the
+// response and make it available via response().
+func executePublish(ag Agent, action Action, t Trigger, functions map[string]govaluate.ExpressionFunction) error {
+	a := ag.(*agent)
+	if len(action.Topic) == 0 {
+		return nil
+	}
+	topic, err := a.actionTopic(action, t, functions)
+	if err != nil {
+		return err
+	}
+	if len(action.ReplyTopic) > 0 {
+		response, received := a.request(action, topic, t, functions)
+		if !received {
+			return errRequestTimeout
+		}
+		functions["response"] = a.responseFunction(response)
+		return nil
+	}
+	s := a.actionPayload(action, t, functions)
+	a.publishWithProperties(topic, action.QoS, action.Retain, s, a.actionProperties(action, functions))
+	return nil
+}
+
+// actionProperties evaluates the MQTT 5 properties of an action. It returns nil if the action
+// does not define any properties.
+func (a *agent) actionProperties(action Action, functions map[string]govaluate.ExpressionFunction) *MessageProperties {
+	if len(action.ContentType) == 0 && len(action.ResponseTopic) == 0 && len(action.CorrelationData) == 0 &&
+		len(action.UserProperties) == 0 && action.MessageExpiry == 0 {
+		return nil
+	}
+
+	p := &MessageProperties{
+		ContentType:     a.EvalExpressionsInString(action.ContentType, functions),
+		ResponseTopic:   a.EvalExpressionsInString(action.ResponseTopic, functions),
+		CorrelationData: a.EvalExpressionsInString(action.CorrelationData, functions),
+		MessageExpiry:   action.MessageExpiry,
+	}
+	if len(action.UserProperties) > 0 {
+		p.UserProperties = make(map[string]string, len(action.UserProperties))
+		for key, value := range action.UserProperties {
+			p.UserProperties[key] = a.EvalExpressionsInString(value, functions)
+		}
+	}
+	return p
 }
 
 func (a *agent) EvalExpressionsInString(in string, functions map[string]govaluate.ExpressionFunction) string {
-	r := regexp.MustCompile("[$][{].*?[}]")
-	out := r.ReplaceAllStringFunc(in, func(i string) string {
+	out := regexExpression.ReplaceAllStringFunc(in, func(i string) string {
 		// ReplaceAllStringFunc always receives the complete match, cannot receive
 		// submatches -> therefore, we chomp first two and last character off in this
 		// hackish way
-		e := i[2 : len(i)-1]
-		expression, err := govaluate.NewEvaluableExpressionWithFunctions(e, functions)
+		result, err := a.evaluateExpression(i[2:len(i)-1], functions)
 		if err != nil {
-			log.Errorln("Error parsing expression:", err)
-			log.Errorln("String: ", in, "; Expression:", e, "; i: ", i)
-			return ""
-		}
-		a.paramMutex.Lock()
-		v := a.parameterValues
-		a.paramMutex.Unlock()
-		result, err := expression.Evaluate(v)
-		if err != nil {
-			log.Errorln("Error evaluating expression:", err)
+			log.Errorf("Error in expression %s of '%s': %v", i, in, err)
 			return ""
 		}
 
+		switch result.(type) {
+		case map[string]interface{}, []interface{}:
+			// JSON objects and arrays, e.g. from payload() or get()
+			return toString(result)
+		}
 		return fmt.Sprintf("%v", result)
 	})
 	return out
 }
+
+// evaluateExpression evaluates a single expression, e.g. from a ${...} template
+func (a *agent) evaluateExpression(e string, functions map[string]govaluate.ExpressionFunction) (interface{}, error) {
+	expression, err := newExpression(e, functions)
+	if err != nil {
+		return nil, err
+	}
+	return evaluate(expression, a.parameterSnapshot())
+}
+
+// parameterSnapshot returns a copy of the parameter values for evaluating expressions, as the
+// values may be changed concurrently by timers and other goroutines
+func (a *agent) parameterSnapshot() map[string]interface{} {
+	a.paramMutex.Lock()
+	defer a.paramMutex.Unlock()
+	values := make(map[string]interface{}, len(a.parameterValues))
+	for key, value := range a.parameterValues {
+		values[key] = value
+	}
+	return values
+}
@@ -249,3 +249,96 @@ func TestAgent_ExecuteRule(t *testing.T) {
 	}
 
 }
+
+func TestAgent_ExecuteRuleBranches(t *testing.T) {
+	mqttClient := test.NewClient()
+	a := New(mqttClient, "")
+	mqttClient.SetSubscriptionCallback(nil)
+
+	a.AddRuleFromString("lights", "level", `{"condition": "payload() > 0",
+		"actions": [{
+			"condition": "payload() > 10", "topic": "light", "payload": "bright",
+			"else": [{
+				"condition": "payload() > 5", "topic": "light", "payload": "dim",
+				"else": [{"topic": "light", "payload": "on"}]
+			}]
+		}],
+		"else": [{"topic": "light", "payload": "off"}]
+	}`)
+	a.AddRuleFromString("lights", "group", `{"actions": [{
+		"condition": "payload() == 1",
+		"actions": [{"topic": "group", "payload": "first"}, {"topic": "group", "payload": "second"}]
+	}]}`)
+
+	for _, c := range []struct {
+		rule    string
+		trigger string
+		topic   string
+		payload string
+	}{
+		{"level", "0", "light", "off"},
+		{"level", "3", "light", "on"},
+		{"level", "7", "light", "dim"},
+		{"level", "20", "light", "bright"},
+		{"group", "2", "light", "bright"},
+		{"group", "1", "group", "second"},
+	} {
+		a.ExecuteRule("lights", c.rule, c.trigger)
+		if m := mqttClient.LastMessage(); m.Topic != c.topic || m.Payload != c.payload {
+			t.Errorf("ExecuteRule(%s, %s) published [%s] %v, want [%s] %s", c.rule, c.trigger, m.Topic, m.Payload, c.topic, c.payload)
+		}
+	}
+}
+
+func TestAgent_AddRuleFromFormattedString(t *testing.T) {
+	mqttClient := test.NewClient()
+	a := New(mqttClient, "mr/")
+
+	a.HandleMessage("mr/rule/ruleset/yaml_rule/yaml", []byte(`
+trigger: test
+actions:
+  - topic: send_topic
+    payload: |
+      line 1
+      line 2
+    qos: 2
+`))
+	r := a.GetRule("ruleset", "yaml_rule")
+	if r == nil || strings.Compare(r.Actions[0].Topic, "send_topic") != 0 ||
+		strings.Compare(r.Actions[0].Payload, "line 1\nline 2\n") != 0 || r.Actions[0].QoS != 2 {
+		t.Errorf("Failed to add YAML rule with correct data")
+		spew.Dump(r)
+	}
+
+	a.HandleMessage("mr/rule/ruleset/toml_rule/toml", []byte(`
+trigger = "test"
+[[actions]]
+topic = "send_topic"
+payload = "send_payload"
+retain = true
+`))
+	r = a.GetRule("ruleset", "toml_rule")
+	if r == nil || strings.Compare(r.Actions[0].Payload, "send_payload") != 0 || r.Actions[0].Retain != true {
+		t.Errorf("Failed to add TOML rule with correct data")
+		spew.Dump(r)
+	}
+
+	a.HandleMessage("mr/rule/ruleset/xml_rule/xml", []byte(`<rule/>`))
+	if r = a.GetRule("ruleset", "xml_rule"); r != nil {
+		t.Errorf("Rule should not have been added: Unknown format")
+	}
+
+	// The MQTT 5 content type takes precedence over the topic suffix
+	a.(*agent).handleMessage(message{topic: "mr/rule/ruleset/typed_rule", payload: "trigger: typed\nactions:\n  - topic: typed_topic\n",
+		properties: &MessageProperties{ContentType: "application/yaml"}})
+	if r = a.GetRule("ruleset", "typed_rule"); r == nil || r.Trigger != "typed" {
+		t.Errorf("Failed to add rule using the format given by the content type")
+		spew.Dump(r)
+	}
+	a.(*agent).handleMessage(message{topic: "mr/rule/ruleset/suffix_rule/toml", payload: "trigger = \"suffix\"\n[[actions]]\ntopic = \"suffix_topic\"\n",
+		properties: &MessageProperties{ContentType: "text/plain"}})
+	if r = a.GetRule("ruleset", "suffix_rule"); r == nil || r.Trigger != "suffix" {
+		t.Errorf("Failed to add rule using the topic suffix for an unknown content type")
+		spew.Dump(r)
+	}
+}
@@ -0,0 +1,122 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var regexPlaceholder = regexp.MustCompile(`[$][(]([A-Za-z_][A-Za-z0-9_.]*)[)]`)
+
+// RuleTemplate is a rule whose strings may contain $(name) placeholders, replaced by the
+// parameters of each instance. Parameters gives the defaults of the placeholders.
+type RuleTemplate struct {
+	Parameters map[string]interface{}
+	Rule       Rule
+}
+
+// RuleInstance creates the rule Ruleset/Rule from a template. When received via a rule/ MQTT
+// message, the rule name is taken from the topic instead.
+type RuleInstance struct {
+	Template   string
+	Ruleset    string
+	Rule       string
+	Parameters map[string]interface{}
+}
+
+// AddTemplate adds or replaces a rule template. Existing instances are not updated.
+func (a *agent) AddTemplate(name string, t RuleTemplate) {
+	if len(t.Rule.Actions) == 0 && len(t.Rule.Else) == 0 {
+		log.WithFields(log.Fields{"component": "Templates", "template": name}).Error("Template does not contain any actions")
+		return
+	}
+	a.templatesMutex.Lock()
+	defer a.templatesMutex.Unlock()
+	a.templates[name] = t
+}
+
+// AddInstance adds the rule defined by a template instance
+func (a *agent) AddInstance(i RuleInstance) {
+	r, err := a.expandTemplate(i)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"component": "Templates",
+			"template":  i.Template,
+			"rule":      fmt.Sprintf("%s/%s", i.Ruleset, i.Rule),
+		}).Errorf("Unable to instantiate template: %v", err)
+		return
+	}
+	a.AddRule(i.Ruleset, i.Rule, r)
+}
+
+// expandTemplate returns the rule of a template with all placeholders replaced
+func (a *agent) expandTemplate(i RuleInstance) (Rule, error) {
+	var r Rule
+
+	a.templatesMutex.Lock()
+	t, exists := a.templates[i.Template]
+	a.templatesMutex.Unlock()
+	if !exists {
+		return r, fmt.Errorf("unknown template '%s'", i.Template)
+	}
+
+	parameters := make(map[string]string, len(t.Parameters)+len(i.Parameters))
+	for key, value := range t.Parameters {
+		parameters[key] = toString(value)
+	}
+	for key, value := range i.Parameters {
+		parameters[key] = toString(value)
+	}
+	// Placeholders for the instance name, e.g. for topics of the rule
+	parameters["ruleset"] = i.Ruleset
+	parameters["rule"] = i.Rule
+
+	// The template rule is expanded as document tree, so that only string values are
+	// affected and the result cannot change the structure of the rule
+	j, err := json.Marshal(t.Rule)
+	if err != nil {
+		return r, err
+	}
+	var doc interface{}
+	if err := json.Unmarshal(j, &doc); err != nil {
+		return r, err
+	}
+	if doc, err = expandPlaceholders(doc, parameters); err != nil {
+		return r, err
+	}
+	err = unmarshalDocument(doc, &r)
+	return r, err
+}
+
+// expandPlaceholders replaces the placeholders in all string values of a document tree
+func expandPlaceholders(in interface{}, parameters map[string]string) (interface{}, error) {
+	var err error
+
+	switch v := in.(type) {
+	case string:
+		out := regexPlaceholder.ReplaceAllStringFunc(v, func(p string) string {
+			name := regexPlaceholder.FindStringSubmatch(p)[1]
+			value, exists := parameters[name]
+			if !exists {
+				err = fmt.Errorf("no value for placeholder %s", p)
+			}
+			return value
+		})
+		return out, err
+	case map[string]interface{}:
+		for key := range v {
+			if v[key], err = expandPlaceholders(v[key], parameters); err != nil {
+				return nil, err
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			if v[i], err = expandPlaceholders(v[i], parameters); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return in, nil
+}
@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/crenz/mqttrules/test"
+	"github.com/davecgh/go-spew/spew"
+)
+
+const thermostatTemplate = `
+config: {}
+templates:
+  thermostat:
+    parameters:
+      setpoint: 20
+    rule:
+      trigger: home/$(room)/temperature
+      condition: payload() < $(setpoint)
+      actions:
+        - topic: home/$(room)/heating/set
+          payload: "on ($(ruleset)/$(rule))"
+instances:
+  - template: thermostat
+    ruleset: heating
+    rule: kitchen
+    parameters:
+      room: kitchen
+`
+
+func TestAgent_RuleTemplate(t *testing.T) {
+	mqttClient := test.NewClient()
+	a := New(mqttClient, "mr/")
+	mqttClient.SetSubscriptionCallback(nil)
+
+	var c ConfigFile
+	if err := unmarshalFormat([]byte(thermostatTemplate), FormatYAML, &c); err != nil {
+		t.Fatalf("Failed to parse template: %v", err)
+	}
+	a.InjectConfigFile(c)
+
+	r := a.GetRule("heating", "kitchen")
+	if r == nil || r.Trigger != "home/kitchen/temperature" || r.Condition != "payload() < 20" {
+		t.Error("Expected rule instantiated from template")
+		spew.Dump(r)
+	}
+
+	expectMessage := func(step string, topic string, payload string) {
+		if m := mqttClient.LastMessage(); m.Topic != topic || m.Payload != payload {
+			t.Errorf("Unexpected message after %s", step)
+			spew.Dump(m)
+		}
+	}
+
+	a.HandleMessage("home/kitchen/temperature", []byte("18"))
+	expectMessage("kitchen below setpoint", "home/kitchen/heating/set", "on (heating/kitchen)")
+
+	a.HandleMessage("mr/rule/heating/bath", []byte(`{"template": "thermostat", "parameters": {"room": "bath", "setpoint": 23}}`))
+	if r := a.GetRule("heating", "bath"); r == nil || r.Condition != "payload() < 23" {
+		t.Error("Expected rule instantiated via MQTT")
+		spew.Dump(r)
+	}
+	a.HandleMessage("home/bath/temperature", []byte("22"))
+	expectMessage("bath below setpoint", "home/bath/heating/set", "on (heating/bath)")
+}
+
+func TestAgent_RuleTemplateInvalid(t *testing.T) {
+	a := New(test.NewClient(), "")
+	a.AddTemplate("light", RuleTemplate{Rule: Rule{
+		Trigger: "$(switch)",
+		Actions: []Action{{Topic: "$(light)/set", Payload: "on"}},
+	}})
+
+	for name, i := range map[string]RuleInstance{
+		"unknown":     {Template: "dimmer", Ruleset: "lights", Rule: "unknown", Parameters: map[string]interface{}{"switch": "s", "light": "l"}},
+		"placeholder": {Template: "light", Ruleset: "lights", Rule: "placeholder", Parameters: map[string]interface{}{"switch": "s"}},
+	} {
+		a.AddInstance(i)
+		if a.GetRule("lights", name) != nil {
+			t.Errorf("Invalid instance %s should be rejected", name)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Knetic/govaluate"
+	log "github.com/Sirupsen/logrus"
+)
+
+// ActionScene is the type of actions activating a scene. The scene is given by the option
+// "scene", its parameters by the option "parameters", whose string values may contain ${...}
+// expressions.
+const ActionScene = "scene"
+
+// Scene is a named list of actions that can be activated from rules, via the topic
+// <prefix>scene/<name> or the $MQTTRULES command "scene <name>". Parameters gives the
+// defaults of the scene parameters, available to the actions via arg("name").
+type Scene struct {
+	Parameters map[string]interface{}
+	Actions    []Action
+}
+
+// AddScene adds or replaces a scene
+func (a *agent) AddScene(name string, s Scene) {
+	if err := a.prepareActions(s.Actions, fmt.Sprintf("scene %s", name)); err != nil {
+		log.WithFields(log.Fields{"component": "Scenes", "scene": name}).Errorf("Invalid action: %v", err)
+		return
+	}
+
+	a.scenesMutex.Lock()
+	defer a.scenesMutex.Unlock()
+	if path := a.scenePath(sceneReferences(s.Actions), name, []string{name}); path != nil {
+		log.WithFields(log.Fields{"component": "Scenes", "scene": name}).Errorf("Scene activates itself: %v", path)
+		return
+	}
+	a.scenes[name] = s
+}
+
+// sceneReferences returns the scenes activated by actions, including nested actions
+func sceneReferences(actions []Action) []string {
+	var scenes []string
+	for _, action := range actions {
+		if action.Type == ActionScene {
+			scenes = append(scenes, toString(action.Options["scene"]))
+		}
+		for _, nested := range [][]Action{action.Actions, action.Else, action.OnTimeout} {
+			scenes = append(scenes, sceneReferences(nested)...)
+		}
+	}
+	return scenes
+}
+
+// scenePath returns the chain of scenes leading from one of scenes to target, or nil if there
+// is none. scenesMutex must be held.
+func (a *agent) scenePath(scenes []string, target string, path []string) []string {
+	for _, name := range scenes {
+		if name == target {
+			return append(path, name)
+		}
+		if s, exists := a.scenes[name]; exists {
+			if result := a.scenePath(sceneReferences(s.Actions), target, append(path, name)); result != nil {
+				return result
+			}
+		}
+	}
+	return nil
+}
+
+// activateScene performs the actions of a scene. args override the default parameters.
+func (a *agent) activateScene(name string, args map[string]interface{}, trigger message) error {
+	a.scenesMutex.Lock()
+	s, exists := a.scenes[name]
+	a.scenesMutex.Unlock()
+	if !exists {
+		return fmt.Errorf("unknown scene '%s'", name)
+	}
+	log.WithFields(log.Fields{"component": "Scenes", "scene": name}).Debug("Activating scene")
+
+	parameters := make(map[string]interface{}, len(s.Parameters)+len(args))
+	for key, value := range s.Parameters {
+		parameters[key] = value
+	}
+	for key, value := range args {
+		parameters[key] = value
+	}
+
+	functions := a.messageFunctions(trigger, fmt.Sprintf("activating scene %s", name))
+	functions["arg"] = func(args ...interface{}) (interface{}, error) {
+		if err := checkArgs("arg", args, 1, 1); err != nil {
+			return nil, err
+		}
+		value, exists := parameters[toString(args[0])]
+		if !exists {
+			return nil, fmt.Errorf("arg(): scene %s has no parameter '%v'", name, args[0])
+		}
+		return value, nil
+	}
+	a.executeActions(s.Actions, functions, trigger)
+	return nil
+}
+
+// activateSceneFromString activates a scene with the parameters given as JSON object in
+// payload, which may be empty
+func (a *agent) activateSceneFromString(name string, payload string) {
+	var args map[string]interface{}
+	if len(strings.TrimSpace(payload)) > 0 {
+		if err := json.Unmarshal([]byte(payload), &args); err != nil {
+			log.WithFields(log.Fields{"component": "Scenes", "scene": name}).Errorf("Invalid scene parameters: %v", err)
+			return
+		}
+	}
+	if err := a.activateScene(name, args, message{}); err != nil {
+		log.WithFields(log.Fields{"component": "Scenes"}).Error(err)
+	}
+}
+
+// sceneNames returns the sorted names of all scenes
+func (a *agent) sceneNames() []string {
+	a.scenesMutex.Lock()
+	defer a.scenesMutex.Unlock()
+	names := make([]string, 0, len(a.scenes))
+	for name := range a.scenes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// executeSceneAction performs actions of type ActionScene
+func executeSceneAction(ag Agent, action Action, t Trigger, functions map[string]govaluate.ExpressionFunction) error {
+	a := ag.(*agent)
+	name, isString := action.Options["scene"].(string)
+	if !isString {
+		return fmt.Errorf("scene action without scene")
+	}
+	var args map[string]interface{}
+	if parameters, exists := action.Options["parameters"]; exists {
+		if args, isString = a.evalJSON(parameters, functions).(map[string]interface{}); !isString {
+			return fmt.Errorf("scene parameters must be an object")
+		}
+	}
+	return a.activateScene(name, args, message{topic: t.Topic, payload: t.Payload, properties: t.Properties, wildcards: t.Wildcards})
+}
@@ -0,0 +1,100 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/crenz/mqttrules/test"
+	"github.com/davecgh/go-spew/spew"
+)
+
+const eveningScene = `
+config: {}
+scenes:
+  evening:
+    parameters:
+      brightness: 40
+    actions:
+      - topic: lights/${arg('room')}/set
+        payload: "${arg('brightness')}"
+rules:
+  lights:
+    sunset:
+      trigger: sun/set
+      actions:
+        - type: scene
+          options:
+            scene: evening
+            parameters:
+              room: "${payload()}"
+`
+
+func TestAgent_Scene(t *testing.T) {
+	mqttClient := test.NewClient()
+	a := New(mqttClient, "mr/")
+	mqttClient.SetSubscriptionCallback(nil)
+
+	var c ConfigFile
+	if err := unmarshalFormat([]byte(eveningScene), FormatYAML, &c); err != nil {
+		t.Fatalf("Failed to parse scene: %v", err)
+	}
+	a.InjectConfigFile(c)
+	a.Subscribe()
+	if !mqttClient.IsSubscribed("mr/scene/+") {
+		t.Error("Expected subscription to scene topic")
+	}
+
+	expectMessage := func(step string, topic string, payload string) {
+		if m := mqttClient.LastMessage(); m.Topic != topic || m.Payload != payload {
+			t.Errorf("Unexpected message after %s", step)
+			spew.Dump(m)
+		}
+	}
+
+	a.HandleMessage("sun/set", []byte("kitchen"))
+	expectMessage("rule action", "lights/kitchen/set", "40")
+
+	a.HandleMessage("mr/scene/evening", []byte(`{"room": "hall", "brightness": 70}`))
+	expectMessage("scene topic", "lights/hall/set", "70")
+
+	a.HandleMessage("mr/$MQTTRULES", []byte(`scene evening {"room": "bath"}`))
+	expectMessage("scene command", "lights/bath/set", "40")
+
+	a.HandleMessage("mr/$MQTTRULES", []byte("scenes"))
+	expectMessage("scenes command", "mr/$MQTTRULES/scenes", "evening")
+
+	a.HandleMessage("mr/scene/morning", []byte(""))
+	expectMessage("unknown scene", "mr/$MQTTRULES/scenes", "evening")
+}
+
+func TestAgent_SceneCycle(t *testing.T) {
+	a := New(test.NewClient(), "")
+	activate := func(scene string) []Action {
+		return []Action{{Type: ActionScene, Options: map[string]interface{}{"scene": scene}}}
+	}
+	a.AddScene("a", Scene{Actions: activate("b")})
+	a.AddScene("b", Scene{Actions: activate("c")})
+	a.AddScene("c", Scene{Actions: activate("a")})
+	if names := a.(*agent).sceneNames(); len(names) != 2 {
+		t.Errorf("Scene cycle should be rejected, got scenes %v", names)
+	}
+}
+
+func TestAgent_SceneTemplate(t *testing.T) {
+	mqttClient := test.NewClient()
+	a := New(mqttClient, "mr/")
+	mqttClient.SetSubscriptionCallback(nil)
+
+	a.AddScene("dim", Scene{
+		Parameters: map[string]interface{}{"level": 30},
+		Actions:    []Action{{Topic: "lights/{{arg \"room\"}}", Payload: `{{arg "level"}}`, Template: true}},
+	})
+	if names := a.(*agent).sceneNames(); len(names) != 1 {
+		t.Fatalf("Scene with template action should be accepted, got scenes %v", names)
+	}
+
+	a.HandleMessage("mr/scene/dim", []byte(`{"room": "hall"}`))
+	if m := mqttClient.LastMessage(); m.Topic != "lights/hall" || m.Payload != "30" {
+		t.Errorf("Unexpected message from scene template")
+		spew.Dump(m)
+	}
+}
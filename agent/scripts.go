@@ -0,0 +1,301 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// Default limits for a single script execution
+const (
+	DefaultScriptTimeout     = time.Second
+	DefaultScriptMemoryLimit = 32 // MB
+)
+
+// Sizes of the Lua call and value stacks available to scripts
+const (
+	scriptCallStackSize   = 128
+	scriptRegistrySize    = 1024
+	scriptRegistryMaxSize = 64 * 1024
+)
+
+var (
+	errScriptTimeout = errors.New("script exceeded time limit")
+	errScriptMemory  = errors.New("script exceeded memory limit")
+)
+
+// compileScript compiles a Lua script once, so it can be executed repeatedly
+func compileScript(source string, name string) (*lua.FunctionProto, error) {
+	chunk, err := parse.Parse(strings.NewReader(source), name)
+	if err != nil {
+		return nil, err
+	}
+	return lua.Compile(chunk, name)
+}
+
+// runScript executes a compiled script in a new sandboxed interpreter and returns the value
+// returned by the script. The trigger message is available as the globals topic and payload.
+func (a *agent) runScript(proto *lua.FunctionProto, trigger message) (lua.LValue, error) {
+	L := a.newScriptState(trigger)
+	defer L.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.scriptTimeout)
+	defer cancel()
+	L.SetContext(ctx)
+	memoryExceeded := watchScriptMemory(ctx, cancel, uint64(a.scriptMemoryLimit)<<20)
+
+	L.Push(L.NewFunctionFromProto(proto))
+	err := L.PCall(0, 1, nil)
+	switch {
+	case atomic.LoadInt32(memoryExceeded) != 0:
+		return lua.LNil, errScriptMemory
+	case ctx.Err() == context.DeadlineExceeded:
+		return lua.LNil, errScriptTimeout
+	case err != nil:
+		return lua.LNil, err
+	}
+	return L.Get(-1), nil
+}
+
+// scriptMemoryPollInterval is the interval at which the heap is checked while a script runs.
+// Reading the heap size stops the world, so it is kept well above typical script run times.
+const scriptMemoryPollInterval = 100 * time.Millisecond
+
+// watchScriptMemory cancels the script execution if the heap grows by more than limit bytes.
+// The limit is approximate and meant to stop runaway scripts, not to account memory exactly:
+// heap usage is measured for the whole process, so concurrent activity counts towards it, and
+// allocations between two checks are not noticed until the next one.
+func watchScriptMemory(ctx context.Context, cancel func(), limit uint64) *int32 {
+	var exceeded int32
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	start := stats.HeapAlloc
+
+	go func() {
+		ticker := time.NewTicker(scriptMemoryPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				runtime.ReadMemStats(&stats)
+				if stats.HeapAlloc > start && stats.HeapAlloc-start > limit {
+					atomic.StoreInt32(&exceeded, 1)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	return &exceeded
+}
+
+// newScriptState creates a Lua interpreter restricted to the base, table, string and math
+// libraries, without access to files or loading code
+func (a *agent) newScriptState(trigger message) *lua.LState {
+	L := lua.NewState(lua.Options{
+		SkipOpenLibs:    true,
+		CallStackSize:   scriptCallStackSize,
+		RegistrySize:    scriptRegistrySize,
+		RegistryMaxSize: scriptRegistryMaxSize,
+	})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"collectgarbage", "dofile", "load", "loadfile", "loadstring", "module", "require", "newproxy", "_printregs"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	memoryLimit := a.scriptMemoryLimit << 20
+	// string.rep could allocate beyond the memory limit before it is checked
+	L.GetGlobal("string").(*lua.LTable).RawSetString("rep", L.NewFunction(func(L *lua.LState) int {
+		s := L.CheckString(1)
+		n := L.CheckInt(2)
+		if len(s) > 0 && n > memoryLimit/len(s) {
+			L.RaiseError("string.rep: result exceeds memory limit")
+		}
+		L.Push(lua.LString(strings.Repeat(s, n)))
+		return 1
+	}))
+
+	L.SetGlobal("topic", lua.LString(trigger.topic))
+	L.SetGlobal("payload", lua.LString(trigger.payload))
+	L.SetGlobal("publish", L.NewFunction(a.scriptPublish))
+	L.SetGlobal("print", L.NewFunction(scriptLog))
+	L.SetGlobal("log", L.NewFunction(scriptLog))
+	L.SetGlobal("json", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"encode": scriptJSONEncode,
+		"decode": scriptJSONDecode,
+	}))
+
+	params := L.NewTable()
+	meta := L.NewTable()
+	L.SetFuncs(meta, map[string]lua.LGFunction{
+		"__index": func(L *lua.LState) int {
+			name := L.CheckString(2)
+			a.paramMutex.Lock()
+			value, exists := a.parameterValues[name]
+			a.paramMutex.Unlock()
+			if !exists {
+				L.Push(lua.LNil)
+				return 1
+			}
+			L.Push(toLuaValue(L, value))
+			return 1
+		},
+		"__newindex": func(L *lua.LState) int {
+			a.SetParameterValue(L.CheckString(2), fromLuaValue(L, L.CheckAny(3)))
+			return 0
+		},
+	})
+	L.SetMetatable(params, meta)
+	L.SetGlobal("params", params)
+
+	return L
+}
+
+// scriptPublish implements publish(topic, payload [, qos [, retain]]). Tables are sent as
+// JSON.
+func (a *agent) scriptPublish(L *lua.LState) int {
+	topic := L.CheckString(1)
+	var payload string
+	switch v := L.CheckAny(2).(type) {
+	case *lua.LTable:
+		b, err := json.Marshal(fromLuaValue(L, v))
+		if err != nil {
+			L.RaiseError("publish: %v", err)
+		}
+		payload = string(b)
+	default:
+		payload = v.String()
+	}
+	a.Publish(topic, byte(L.OptInt(3, 0)), L.OptBool(4, false), payload)
+	return 0
+}
+
+func scriptLog(L *lua.LState) int {
+	var args []string
+	for i := 1; i <= L.GetTop(); i++ {
+		args = append(args, L.Get(i).String())
+	}
+	log.WithFields(log.Fields{"component": "Script"}).Info(strings.Join(args, " "))
+	return 0
+}
+
+func scriptJSONEncode(L *lua.LState) int {
+	b, err := json.Marshal(fromLuaValue(L, L.CheckAny(1)))
+	if err != nil {
+		L.RaiseError("json.encode: %v", err)
+	}
+	L.Push(lua.LString(b))
+	return 1
+}
+
+func scriptJSONDecode(L *lua.LState) int {
+	var v interface{}
+	if err := json.Unmarshal([]byte(L.CheckString(1)), &v); err != nil {
+		L.RaiseError("json.decode: %v", err)
+	}
+	L.Push(toLuaValue(L, v))
+	return 1
+}
+
+// toLuaValue converts parameter values and decoded JSON to Lua values
+func toLuaValue(L *lua.LState, v interface{}) lua.LValue {
+	switch v := v.(type) {
+	case nil:
+		return lua.LNil
+	case bool:
+		return lua.LBool(v)
+	case float64:
+		return lua.LNumber(v)
+	case int:
+		return lua.LNumber(v)
+	case json.Number:
+		f, _ := v.Float64()
+		return lua.LNumber(f)
+	case string:
+		return lua.LString(v)
+	case []interface{}:
+		t := L.CreateTable(len(v), 0)
+		for _, e := range v {
+			t.Append(toLuaValue(L, e))
+		}
+		return t
+	case map[string]interface{}:
+		t := L.CreateTable(0, len(v))
+		for key, e := range v {
+			t.RawSetString(key, toLuaValue(L, e))
+		}
+		return t
+	}
+	return lua.LString(fmt.Sprintf("%v", v))
+}
+
+// maxScriptValueDepth limits the nesting of tables converted to Go values
+const maxScriptValueDepth = 100
+
+// fromLuaValue converts Lua values to Go values. Tables with consecutive integer keys starting
+// at 1 become arrays, all other tables maps. A Lua error is raised for tables containing
+// themselves or nested too deeply.
+func fromLuaValue(L *lua.LState, v lua.LValue) interface{} {
+	return convertLuaValue(L, v, make(map[*lua.LTable]bool))
+}
+
+// convertLuaValue converts v; path holds the tables v is nested in
+func convertLuaValue(L *lua.LState, v lua.LValue, path map[*lua.LTable]bool) interface{} {
+	switch v := v.(type) {
+	case lua.LBool:
+		return bool(v)
+	case lua.LNumber:
+		return float64(v)
+	case lua.LString:
+		return string(v)
+	case *lua.LTable:
+		if path[v] {
+			L.RaiseError("table contains itself")
+		}
+		if len(path) >= maxScriptValueDepth {
+			L.RaiseError("tables nested deeper than %d levels", maxScriptValueDepth)
+		}
+		path[v] = true
+		defer delete(path, v)
+
+		n := v.MaxN()
+		count := 0
+		v.ForEach(func(lua.LValue, lua.LValue) { count++ })
+		if n > 0 && n == count {
+			array := make([]interface{}, 0, n)
+			for i := 1; i <= n; i++ {
+				array = append(array, convertLuaValue(L, v.RawGetInt(i), path))
+			}
+			return array
+		}
+		m := make(map[string]interface{}, count)
+		v.ForEach(func(key lua.LValue, value lua.LValue) {
+			m[key.String()] = convertLuaValue(L, value, path)
+		})
+		return m
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/crenz/mqttrules/test"
+	"github.com/davecgh/go-spew/spew"
+)
+
+func TestAgent_ScriptAction(t *testing.T) {
+	mqttClient := test.NewClient()
+	a := New(mqttClient, "")
+	mqttClient.SetSubscriptionCallback(nil)
+	a.SetParameterFromString("offset", "1")
+
+	a.AddRule("sensors", "sum", Rule{Trigger: "sensors/all", Actions: []Action{{Script: `
+		local sensors = json.decode(payload).sensors
+		local total = 0
+		for _, s in ipairs(sensors) do total = total + s.value + params.offset end
+		params.total = total
+		publish("sensors/summary", {count = #sensors, total = total, source = {topic = topic}}, 1)
+	`}}})
+	a.(*agent).executeRule("sensors", "sum", message{topic: "sensors/all", payload: `{"sensors": [{"value": 2}, {"value": 3}]}`})
+
+	m := mqttClient.LastMessage()
+	if m.Topic != "sensors/summary" || m.QoS != 1 || m.Payload != `{"count":2,"source":{"topic":"sensors/all"},"total":7}` {
+		t.Errorf("Script did not publish expected message")
+		spew.Dump(m)
+	}
+	if v := a.GetParameterValue("total"); v != 7.0 {
+		t.Errorf("Script did not set parameter, got %v", v)
+	}
+}
+
+func TestAgent_ConditionScript(t *testing.T) {
+	mqttClient := test.NewClient()
+	a := New(mqttClient, "")
+	mqttClient.SetSubscriptionCallback(nil)
+
+	a.AddRuleFromString("doors", "open", `{
+		"conditionScript": "for _, d in ipairs(json.decode(payload)) do if d.open then return true end end return false",
+		"actions": [{"topic": "doors/state", "payload": "open"}],
+		"else": [{"topic": "doors/state", "payload": "closed"}]
+	}`)
+	for trigger, state := range map[string]string{
+		`[{"open": false}, {"open": true}]`:  "open",
+		`[{"open": false}, {"open": false}]`: "closed",
+	} {
+		a.ExecuteRule("doors", "open", trigger)
+		if m := mqttClient.LastMessage(); m.Payload != state {
+			t.Errorf("ExecuteRule(%s) published %v, want %s", trigger, m.Payload, state)
+		}
+	}
+
+	a.AddRuleFromString("doors", "invalid", `{"conditionScript": "return (", "actions": [{"topic": "doors/state"}]}`)
+	if a.GetRule("doors", "invalid") != nil {
+		t.Errorf("Rule with invalid script should not be added")
+	}
+}
+
+func TestAgent_ScriptSandbox(t *testing.T) {
+	a := New(test.NewClient(), "").(*agent)
+	a.scriptTimeout = 100 * time.Millisecond
+	a.scriptMemoryLimit = 1
+
+	for _, c := range []struct {
+		script string
+		err    error
+	}{
+		{"return io == nil and os == nil and load == nil and require == nil and dofile == nil", nil},
+		{"while true do end", errScriptTimeout},
+		{"local t = {} for i = 1, 1e9 do t[i] = {i} end", errScriptMemory},
+	} {
+		proto, err := compileScript(c.script, "test")
+		if err != nil {
+			t.Fatalf("Failed to compile %q: %v", c.script, err)
+		}
+		if c.err == errScriptMemory {
+			a.scriptTimeout = 10 * time.Second
+		}
+		result, err := a.runScript(proto, message{})
+		if err != c.err || (c.err == nil && result.String() != "true") {
+			t.Errorf("runScript(%q) = %v, %v; want error %v", c.script, result, err, c.err)
+		}
+	}
+
+	for _, script := range []string{
+		"local t = {} t.self = t publish('x', t)",
+		"local t = {1} t[2] = t return json.encode(t)",
+		"local t = {} for i = 1, 1000 do t = {t} end params.nested = t",
+	} {
+		proto, _ := compileScript(script, "test")
+		if _, err := a.runScript(proto, message{}); err == nil {
+			t.Errorf("runScript(%q) should fail for recursive or deeply nested tables", script)
+		}
+	}
+	proto, _ := compileScript("local shared = {1} return json.encode({shared, shared})", "test")
+	if result, err := a.runScript(proto, message{}); err != nil || result.String() != "[[1],[1]]" {
+		t.Errorf("Tables referenced twice should be encoded, got %v, %v", result, err)
+	}
+
+	proto, _ = compileScript("return string.rep('x', 1e9)", "test")
+	if _, err := a.runScript(proto, message{}); err == nil {
+		t.Errorf("string.rep should fail beyond memory limit")
+	}
+}
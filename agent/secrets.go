@@ -0,0 +1,60 @@
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var regexSecret = regexp.MustCompile(`[$][{](ENV|FILE):([^}]+)[}]`)
+
+// ExpandSecrets replaces ${ENV:NAME} with the value of the environment variable NAME and
+// ${FILE:/path/to/file} with the contents of the given file (without trailing line breaks).
+// This allows e.g. broker credentials to be supplied as Docker or Kubernetes secrets.
+func ExpandSecrets(in string) (string, error) {
+	var e error
+	out := regexSecret.ReplaceAllStringFunc(in, func(i string) string {
+		res := regexSecret.FindStringSubmatch(i)
+		switch res[1] {
+		case "ENV":
+			v, exists := os.LookupEnv(res[2])
+			if !exists {
+				e = fmt.Errorf("environment variable %s is not set", res[2])
+			}
+			return v
+		default:
+			data, err := ioutil.ReadFile(res[2])
+			if err != nil {
+				e = err
+				return ""
+			}
+			return strings.TrimRight(string(data), "\r\n")
+		}
+	})
+	return out, e
+}
+
+// expandDocumentSecrets runs ExpandSecrets on all string values of a document tree
+func expandDocumentSecrets(in interface{}) (interface{}, error) {
+	var err error
+
+	switch v := in.(type) {
+	case string:
+		return ExpandSecrets(v)
+	case map[string]interface{}:
+		for key := range v {
+			if v[key], err = expandDocumentSecrets(v[key]); err != nil {
+				return nil, err
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			if v[i], err = expandDocumentSecrets(v[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return in, nil
+}
@@ -0,0 +1,322 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Knetic/govaluate"
+	log "github.com/Sirupsen/logrus"
+	"github.com/oliveagle/jsonpath"
+)
+
+// Sequence triggers a rule when events on several topics occur in order within a time window,
+// e.g. "door opened, then no motion within 2 minutes" or "three failed logins within 60s".
+type Sequence struct {
+	Steps []SequenceStep
+	// Maximum time in seconds between the first and the last event of the sequence
+	Window float64
+}
+
+// SequenceStep is matched by Count messages (default 1) with the topic Topic for which
+// Condition evaluates to true. An Absent step, which may only be the last step, is matched if
+// no such message arrives before the time window ends.
+type SequenceStep struct {
+	Topic     string
+	Condition string
+	Count     int
+	Absent    bool
+}
+
+const sequenceEvent = "sequence/"
+
+// sequenceState holds the events that may be part of a match
+type sequenceState struct {
+	mutex  sync.Mutex
+	events []sequenceMatch
+	// Identifies the timer of an absent step, incremented whenever the timer is invalidated
+	generation int
+	timer      *time.Timer
+}
+
+// sequenceMatch is an event matching one or more steps of a sequence
+type sequenceMatch struct {
+	time  time.Time
+	steps map[int]bool
+	m     message
+}
+
+func (s *Sequence) window() time.Duration {
+	return time.Duration(s.Window * float64(time.Second))
+}
+
+func (s *Sequence) absent() bool {
+	return s.Steps[len(s.Steps)-1].Absent
+}
+
+func sequenceTopic(ruleset string, rule string) string {
+	return EventTopic(sequenceEvent + ruleset + "/" + rule)
+}
+
+// triggers returns the topics the sequence of a rule reacts to
+func (s *Sequence) triggers(ruleset string, rule string) []string {
+	topics := []string{sequenceTopic(ruleset, rule)}
+	for _, step := range s.Steps {
+		topics = append(topics, step.Topic)
+	}
+	return topics
+}
+
+func (a *agent) checkSequence(s *Sequence) error {
+	if len(s.Steps) == 0 {
+		return fmt.Errorf("sequence without steps")
+	}
+	if s.Window <= 0 {
+		return fmt.Errorf("sequence without time window")
+	}
+	for i, step := range s.Steps {
+		if len(step.Topic) == 0 {
+			return fmt.Errorf("step %d: missing topic", i)
+		}
+		if step.Absent && (i == 0 || i != len(s.Steps)-1) {
+			return fmt.Errorf("step %d: only the last step can be absent", i)
+		}
+		if len(step.Condition) > 0 {
+			if _, err := newExpression(step.Condition, a.messageFunctions(message{}, "")); err != nil {
+				return fmt.Errorf("step %d: %v", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (a *agent) addSequenceSubscriptions(ruleset string, rule string, s *Sequence) {
+	for _, topic := range s.triggers(ruleset, rule) {
+		if a.ensureSubscription(topic) {
+			a.subscriptions[topic].sequences[rulesKey{ruleset, rule}] = true
+		}
+	}
+}
+
+func (a *agent) removeSequenceSubscriptions(ruleset string, rule string, s *Sequence) {
+	for _, topic := range s.triggers(ruleset, rule) {
+		if _, exists := a.subscriptions[topic]; exists {
+			delete(a.subscriptions[topic].sequences, rulesKey{ruleset, rule})
+			a.contemplateUnsubscription(topic)
+		}
+	}
+}
+
+// handleSequenceEvent records a message received for the sequence trigger of a rule and
+// executes the rule if the sequence is complete
+func (a *agent) handleSequenceEvent(key rulesKey, filter string, m message) {
+	r := a.GetRule(key.ruleset, key.rule)
+	if r == nil || r.Sequence == nil {
+		return
+	}
+	s, state := r.Sequence, r.sequence
+
+	if filter == sequenceTopic(key.ruleset, key.rule) {
+		// Time window of a sequence ending with an absent step has passed
+		state.mutex.Lock()
+		matched := m.payload == strconv.Itoa(state.generation) && a.matchSequence(s, state) == len(s.Steps)-1
+		events := state.reset()
+		state.mutex.Unlock()
+		if matched {
+			a.executeSequenceRule(key, events, message{})
+		}
+		return
+	}
+
+	functions := a.messageFunctions(m, fmt.Sprintf("evaluating sequence of rule %s/%s", key.ruleset, key.rule))
+	steps := make(map[int]bool)
+	for i, step := range s.Steps {
+		if step.Topic != filter {
+			continue
+		}
+		if result, ok := a.evaluateCondition(step.Condition, functions); ok && result {
+			steps[i] = true
+		}
+	}
+	if len(steps) == 0 {
+		return
+	}
+
+	now := time.Now()
+	state.mutex.Lock()
+	state.expire(s, now.Add(-s.window()))
+	before := a.matchSequence(s, state)
+	if s.absent() && before == len(s.Steps)-1 && steps[len(s.Steps)-1] {
+		// The absent event occurred: the sequence does not match
+		state.reset()
+		state.mutex.Unlock()
+		return
+	}
+	state.record(s, sequenceMatch{now, steps, m})
+	matched := a.matchSequence(s, state)
+
+	var events []sequenceMatch
+	switch {
+	case matched == len(s.Steps):
+		events = state.reset()
+	case s.absent() && matched == len(s.Steps)-1 && state.timer == nil:
+		// Wait for the end of the time window, starting at the first event
+		state.generation++
+		generation := strconv.Itoa(state.generation)
+		wait := state.events[0].time.Add(s.window()).Sub(now)
+		state.timer = time.AfterFunc(wait, func() {
+			a.raiseEvent(sequenceEvent+key.ruleset+"/"+key.rule, generation)
+		})
+	}
+	state.mutex.Unlock()
+
+	if events != nil {
+		a.executeSequenceRule(key, events, m)
+	}
+}
+
+// matchSequence returns the number of steps matched by the recorded events. Events are
+// assigned to steps in order; events not matching the next step are skipped.
+func (a *agent) matchSequence(s *Sequence, state *sequenceState) int {
+	step, _, _ := sequenceProgress(s, state.events)
+	return step
+}
+
+// sequenceProgress assigns events to the steps of s in order. It returns the number of
+// complete steps, the number of events assigned to the next step and the assigned events.
+func sequenceProgress(s *Sequence, events []sequenceMatch) (int, int, []sequenceMatch) {
+	step, count := 0, 0
+	var used []sequenceMatch
+	for _, e := range events {
+		if step >= len(s.Steps) || s.Steps[step].Absent {
+			break
+		}
+		if !e.steps[step] {
+			continue
+		}
+		used = append(used, e)
+		count++
+		if count >= s.Steps[step].count() {
+			step++
+			count = 0
+		}
+	}
+	return step, count, used
+}
+
+func (step SequenceStep) count() int {
+	if step.Count > 1 {
+		return step.Count
+	}
+	return 1
+}
+
+// record adds an event if it can take part in a match, so that repeated events do not
+// accumulate. An event repeating the last complete step replaces the oldest event of that
+// step, which keeps the match within the time window as long as possible.
+func (state *sequenceState) record(s *Sequence, e sequenceMatch) {
+	step, count, _ := sequenceProgress(s, state.events)
+	switch {
+	case step < len(s.Steps) && e.steps[step]:
+		state.events = append(state.events, e)
+	case step > 0 && count == 0 && e.steps[step-1]:
+		i := len(state.events) - s.Steps[step-1].count()
+		state.events = append(append(state.events[:i:i], state.events[i+1:]...), e)
+		// The time window may start later, so the timer of an absent step is restarted
+		state.stopTimer()
+	}
+}
+
+// expire drops events older than t and the events no longer taking part in the match; the
+// timer of an absent step is invalidated as the match may change
+func (state *sequenceState) expire(s *Sequence, t time.Time) {
+	i := 0
+	for i < len(state.events) && state.events[i].time.Before(t) {
+		i++
+	}
+	if i > 0 {
+		_, _, state.events = sequenceProgress(s, state.events[i:])
+		state.stopTimer()
+	}
+}
+
+// reset clears the recorded events and returns them
+func (state *sequenceState) reset() []sequenceMatch {
+	events := state.events
+	state.events = nil
+	state.stopTimer()
+	return events
+}
+
+func (state *sequenceState) stopTimer() {
+	if state.timer != nil {
+		state.timer.Stop()
+		state.timer = nil
+	}
+	state.generation++
+}
+
+// executeSequenceRule executes a rule triggered by a complete sequence. trigger is the last
+// event, or empty if the sequence ended with an absent step.
+func (a *agent) executeSequenceRule(key rulesKey, events []sequenceMatch, trigger message) {
+	log.WithFields(log.Fields{
+		"component": "Rules",
+		"ruleset":   key.ruleset,
+		"rule":      key.rule,
+		"events":    len(events),
+	}).Debug("Sequence matched")
+
+	trigger.events = make([]message, len(events))
+	for i, e := range events {
+		trigger.events[i] = e.m
+	}
+	a.executeRule(key.ruleset, key.rule, trigger)
+}
+
+// registerSequenceFunctions adds event(i [, path]) and eventTopic(i), giving access to the
+// messages matched by a sequence trigger, counting from 0
+func registerSequenceFunctions(r *Registry) {
+	event := func(name string, t Trigger, args []interface{}) (*Trigger, error) {
+		i, err := number(name, firstArg(args))
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 || int(i) >= len(t.Events) {
+			return nil, fmt.Errorf("%s(): no event %v", name, args[0])
+		}
+		return &t.Events[int(i)], nil
+	}
+	r.RegisterFunctionFactory("event", func(ag Agent, t Trigger) govaluate.ExpressionFunction {
+		return func(args ...interface{}) (interface{}, error) {
+			if err := checkArgs("event", args, 1, 2); err != nil {
+				return nil, err
+			}
+			e, err := event("event", t, args)
+			if err != nil {
+				return nil, err
+			}
+			if len(args) == 1 {
+				return ag.(*agent).parseParameterValue(e.Payload), nil
+			}
+			var data interface{}
+			if err := json.Unmarshal([]byte(e.Payload), &data); err != nil {
+				return nil, fmt.Errorf("event(): payload is not JSON")
+			}
+			return jsonpath.JsonPathLookup(data, toString(args[1]))
+		}
+	})
+	r.RegisterFunctionFactory("eventTopic", func(ag Agent, t Trigger) govaluate.ExpressionFunction {
+		return func(args ...interface{}) (interface{}, error) {
+			if err := checkArgs("eventTopic", args, 1, 1); err != nil {
+				return nil, err
+			}
+			e, err := event("eventTopic", t, args)
+			if err != nil {
+				return nil, err
+			}
+			return e.Topic, nil
+		}
+	})
+}
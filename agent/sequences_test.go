@@ -0,0 +1,129 @@
+package agent
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/crenz/mqttrules/test"
+	"github.com/davecgh/go-spew/spew"
+)
+
+func TestAgent_SequenceCount(t *testing.T) {
+	mqttClient := test.NewClient()
+	a := New(mqttClient, "")
+	mqttClient.SetSubscriptionCallback(nil)
+
+	a.AddRuleFromString("security", "logins", `{
+		"sequence": {"window": 0.2, "steps": [{"topic": "auth/+/failed", "count": 3}]},
+		"actions": [{"topic": "alerts/logins", "payload": "${eventTopic(0)} ${event(2, '$.user')} ${payload('$.user')}"}]
+	}`)
+	if !mqttClient.IsSubscribed("auth/+/failed") {
+		t.Error("Expected subscription to sequence step topic")
+	}
+
+	mqttClient.Publish("previous", 0, false, "")
+	a.HandleMessage("auth/ssh/failed", []byte(`{"user": "root"}`))
+	time.Sleep(250 * time.Millisecond)
+	a.HandleMessage("auth/ssh/failed", []byte(`{"user": "admin"}`))
+	a.HandleMessage("auth/web/failed", []byte(`{"user": "bob"}`))
+	if m := mqttClient.LastMessage(); m.Topic != "previous" {
+		t.Error("Events outside the time window should not count")
+		spew.Dump(m)
+	}
+
+	a.HandleMessage("auth/web/failed", []byte(`{"user": "eve"}`))
+	if m := mqttClient.LastMessage(); m.Topic != "alerts/logins" || m.Payload != "auth/ssh/failed eve eve" {
+		t.Error("Unexpected message for complete sequence")
+		spew.Dump(m)
+	}
+
+	// Matched events are cleared
+	mqttClient.Publish("previous", 0, false, "")
+	a.HandleMessage("auth/web/failed", []byte(`{"user": "eve"}`))
+	if m := mqttClient.LastMessage(); m.Topic != "previous" {
+		t.Error("Sequence should start over after a match")
+	}
+}
+
+func TestAgent_SequenceAbsent(t *testing.T) {
+	mqttClient := test.NewClient()
+	a := New(mqttClient, "")
+	mqttClient.SetSubscriptionCallback(nil)
+
+	a.AddRule("security", "door", Rule{
+		Sequence: &Sequence{Window: 0.1, Steps: []SequenceStep{
+			{Topic: "home/door", Condition: "payload() == 'open'"},
+			{Topic: "home/motion", Absent: true},
+		}},
+		Actions: []Action{{Topic: "alerts/door", Payload: "no motion after ${event(0)}"}},
+	})
+
+	// Motion within the time window
+	mqttClient.Publish("previous", 0, false, "")
+	a.HandleMessage("home/door", []byte("closed"))
+	a.HandleMessage("home/door", []byte("open"))
+	a.HandleMessage("home/motion", []byte("1"))
+	time.Sleep(150 * time.Millisecond)
+	select {
+	case m := <-a.(*agent).incoming:
+		a.(*agent).handleMessage(m)
+	default:
+	}
+	if m := mqttClient.LastMessage(); m.Topic != "previous" {
+		t.Error("Sequence should not match if the absent event occurs")
+		spew.Dump(m)
+	}
+
+	// No motion
+	a.HandleMessage("home/door", []byte("open"))
+	time.Sleep(150 * time.Millisecond)
+	a.Listen()
+	if m := mqttClient.LastMessage(); m.Topic != "alerts/door" || m.Payload != "no motion after open" {
+		t.Error("Unexpected message for sequence with absent step")
+		spew.Dump(m)
+	}
+}
+
+func TestAgent_SequenceInvalid(t *testing.T) {
+	a := New(test.NewClient(), "")
+	for name, s := range map[string]Sequence{
+		"empty":  {Window: 1},
+		"window": {Steps: []SequenceStep{{Topic: "a"}}},
+		"absent": {Window: 1, Steps: []SequenceStep{{Topic: "a", Absent: true}, {Topic: "b"}}},
+		"topic":  {Window: 1, Steps: []SequenceStep{{Condition: "true"}}},
+	} {
+		s := s
+		a.AddRule("sequences", name, Rule{Sequence: &s, Actions: []Action{{Topic: "out"}}})
+		if a.GetRule("sequences", name) != nil {
+			t.Errorf("Invalid sequence %s should be rejected", name)
+		}
+	}
+}
+
+func TestAgent_SequenceRepeatedEvents(t *testing.T) {
+	mqttClient := test.NewClient()
+	a := New(mqttClient, "")
+	mqttClient.SetSubscriptionCallback(nil)
+
+	a.AddRule("alarm", "entry", Rule{
+		Sequence: &Sequence{Window: 60, Steps: []SequenceStep{
+			{Topic: "home/door", Count: 2},
+			{Topic: "home/alarm"},
+		}},
+		Actions: []Action{{Topic: "alerts/entry", Payload: "${event(0)} ${event(1)}"}},
+	})
+
+	for i := 0; i < 1000; i++ {
+		a.HandleMessage("home/door", []byte(strconv.Itoa(i)))
+	}
+	if n := len(a.GetRule("alarm", "entry").sequence.events); n != 2 {
+		t.Errorf("Expected only the events taking part in the match to be kept, got %d", n)
+	}
+
+	a.HandleMessage("home/alarm", []byte("on"))
+	if m := mqttClient.LastMessage(); m.Topic != "alerts/entry" || m.Payload != "998 999" {
+		t.Error("Sequence should match the most recent events")
+		spew.Dump(m)
+	}
+}
@@ -0,0 +1,115 @@
+package agent
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Knetic/govaluate"
+	log "github.com/Sirupsen/logrus"
+)
+
+// EventParameterStale is raised when a parameter with MaxAge has not been updated in time.
+// The event topic includes the parameter name, e.g. "$MQTTRULES/event/parameterStale/temperature",
+// so EventTopic(EventParameterStale + "/+") triggers on all parameters.
+const EventParameterStale = "parameterStale"
+
+// freshness tracks when a parameter was last updated
+type freshness struct {
+	updated time.Time
+	stale   bool
+	timer   *time.Timer
+}
+
+// resetFreshness starts tracking the age of a newly defined parameter. paramMutex must be held.
+func (a *agent) resetFreshness(name string, p *Parameter) {
+	if f, exists := a.freshness[name]; exists && f.timer != nil {
+		f.timer.Stop()
+	}
+	f := &freshness{updated: time.Now()}
+	if maxAge := p.maxAge(); maxAge > 0 {
+		f.timer = time.AfterFunc(maxAge, func() { a.markStale(name, f) })
+	}
+	a.freshness[name] = f
+}
+
+// refreshParameter records an update of a parameter. paramMutex must be held.
+func (a *agent) refreshParameter(name string) {
+	f, exists := a.freshness[name]
+	if !exists {
+		a.freshness[name] = &freshness{updated: time.Now()}
+		return
+	}
+	f.updated = time.Now()
+	f.stale = false
+	if p, exists := a.parameters[name]; exists && f.timer != nil {
+		f.timer.Reset(p.maxAge())
+	}
+}
+
+func (p *Parameter) maxAge() time.Duration {
+	return time.Duration(p.MaxAge * float64(time.Second))
+}
+
+// markStale is called when the MaxAge of a parameter has passed without update
+func (a *agent) markStale(name string, f *freshness) {
+	a.paramMutex.Lock()
+	p, exists := a.parameters[name]
+	if !exists || a.freshness[name] != f || f.stale || time.Since(f.updated) < p.maxAge() {
+		a.paramMutex.Unlock()
+		return
+	}
+	f.stale = true
+	a.paramMutex.Unlock()
+
+	log.WithFields(log.Fields{
+		"component": "Parameters",
+		"parameter": name,
+	}).Warn("Parameter is stale")
+	if p.StaleValue != nil {
+		a.setParameterValue(name, p.StaleValue, false)
+	}
+	a.raiseEvent(EventParameterStale+"/"+name, name)
+}
+
+// registerStalenessFunctions adds isStale(name) and age(name), which returns the number of
+// seconds since the last update of a parameter
+func registerStalenessFunctions(r *Registry) {
+	r.RegisterFunctionFactory("isStale", func(ag Agent, t Trigger) govaluate.ExpressionFunction {
+		a := ag.(*agent)
+		return func(args ...interface{}) (interface{}, error) {
+			f, err := a.parameterFreshness("isStale", args)
+			if err != nil {
+				return nil, err
+			}
+			return f.stale, nil
+		}
+	})
+	r.RegisterFunctionFactory("age", func(ag Agent, t Trigger) govaluate.ExpressionFunction {
+		a := ag.(*agent)
+		return func(args ...interface{}) (interface{}, error) {
+			f, err := a.parameterFreshness("age", args)
+			if err != nil {
+				return nil, err
+			}
+			return time.Since(f.updated).Seconds(), nil
+		}
+	})
+}
+
+// parameterFreshness returns a copy of the freshness of the parameter named by args
+func (a *agent) parameterFreshness(function string, args []interface{}) (freshness, error) {
+	if err := checkArgs(function, args, 1, 1); err != nil {
+		return freshness{}, err
+	}
+	name, isString := args[0].(string)
+	if !isString {
+		return freshness{}, fmt.Errorf("%s(): expects the name of a parameter", function)
+	}
+	a.paramMutex.Lock()
+	defer a.paramMutex.Unlock()
+	f, exists := a.freshness[name]
+	if !exists {
+		return freshness{}, fmt.Errorf("%s(): unknown parameter '%s'", function, name)
+	}
+	return *f, nil
+}
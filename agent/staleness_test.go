@@ -0,0 +1,54 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/crenz/mqttrules/test"
+	"github.com/davecgh/go-spew/spew"
+)
+
+func TestAgent_StaleParameters(t *testing.T) {
+	mqttClient := test.NewClient()
+	a := New(mqttClient, "")
+	mqttClient.SetSubscriptionCallback(nil)
+
+	a.SetParameterFromString("temperature", `{"value": 21, "topic": "sensors/temperature", "maxAge": 0.1, "staleValue": -1}`)
+	a.AddRuleFromString("sensors", "stale", `{
+		"trigger": "$MQTTRULES/event/parameterStale/+",
+		"actions": [{"topic": "alerts/stale/${wildcard(0)}", "payload": "${payload()} ${temperature}"}]
+	}`)
+
+	functions := a.(*agent).messageFunctions(message{}, "")
+	if stale, err := a.(*agent).evaluateExpression(`isStale("temperature")`, functions); err != nil || stale != false {
+		t.Errorf("Parameter should not be stale yet: %v %v", stale, err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	a.HandleMessage("sensors/temperature", []byte("22"))
+	if age, err := a.(*agent).evaluateExpression(`age("temperature")`, functions); err != nil || age.(float64) > 0.04 {
+		t.Errorf("Update should reset the age, got %v %v", age, err)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if stale, err := a.(*agent).evaluateExpression(`isStale("temperature")`, functions); err != nil || stale != true {
+		t.Errorf("Parameter should be stale: %v %v", stale, err)
+	}
+	if v := a.GetParameterValue("temperature"); v != -1.0 {
+		t.Errorf("Stale parameter should be reset to staleValue, got %v", v)
+	}
+
+	a.Listen()
+	if m := mqttClient.LastMessage(); m.Topic != "alerts/stale/temperature" || m.Payload != "temperature -1" {
+		t.Error("Unexpected message for stale event")
+		spew.Dump(m)
+	}
+
+	a.HandleMessage("sensors/temperature", []byte("23"))
+	if stale, _ := a.(*agent).evaluateExpression(`isStale("temperature")`, functions); stale != false {
+		t.Error("Parameter should be fresh after update")
+	}
+	if _, err := a.(*agent).evaluateExpression(`age("humidity")`, functions); err == nil {
+		t.Error("Expected error for unknown parameter")
+	}
+}
@@ -0,0 +1,362 @@
+package agent
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// StateMachine defines a finite state machine. Its current state is available as the
+// parameter named like the state machine (or Parameter), which is published on change.
+type StateMachine struct {
+	Initial string
+	States  map[string]State
+	// Name of the parameter holding the current state; defaults to the state machine name
+	Parameter string
+}
+
+// State of a state machine. Entry and Exit actions are performed when the state is entered
+// or left. If the state is not left within Timeout seconds, the state machine changes to
+// TimeoutState.
+type State struct {
+	Entry        []Action
+	Exit         []Action
+	Transitions  []Transition
+	Timeout      float64
+	TimeoutState string
+}
+
+// Transition to the state Target. Transitions with a Trigger are taken when a message with
+// that topic is received and Condition evaluates to true; transitions without a Trigger as
+// soon as Condition evaluates to true. Actions are performed between the exit actions of the
+// current state and the entry actions of the target state.
+type Transition struct {
+	Trigger   string
+	Condition string
+	Target    string
+	Actions   []Action
+}
+
+// maxTransitionChain limits the number of condition transitions taken in a row, so that
+// conditions switching back and forth cannot block the agent
+const maxTransitionChain = 10
+
+const stateTimeoutEvent = "stateTimeout/"
+
+type stateMachine struct {
+	StateMachine
+	name string
+
+	// Guards the current state, which may be changed by Listen, timers and API calls. It is
+	// not held while actions are performed, as these may change parameters again.
+	mutex   sync.Mutex
+	current string
+	// Incremented on each state change, identifies the timeout events of the current state
+	entered int
+	timer   *time.Timer
+}
+
+// state returns the current state and its sequence number
+func (m *stateMachine) state() (string, int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.current, m.entered
+}
+
+func (m *stateMachine) parameter() string {
+	if len(m.Parameter) > 0 {
+		return m.Parameter
+	}
+	return m.name
+}
+
+// triggers returns the topics the state machine reacts to
+func (m *stateMachine) triggers() []string {
+	topics := []string{EventTopic(stateTimeoutEvent + m.name)}
+	for _, s := range m.States {
+		for _, t := range s.Transitions {
+			if len(t.Trigger) > 0 {
+				topics = append(topics, t.Trigger)
+			}
+		}
+	}
+	return topics
+}
+
+// checkStateMachine validates the states and transitions and prepares the actions of a state
+// machine
+func (a *agent) checkStateMachine(m *stateMachine) error {
+	if _, exists := m.States[m.Initial]; !exists {
+		return fmt.Errorf("unknown initial state '%s'", m.Initial)
+	}
+	for name, s := range m.States {
+		if s.Timeout > 0 {
+			if _, exists := m.States[s.TimeoutState]; !exists {
+				return fmt.Errorf("state %s: unknown timeout state '%s'", name, s.TimeoutState)
+			}
+		}
+		actionName := fmt.Sprintf("state machine %s/%s", m.name, name)
+		for _, actions := range [][]Action{s.Entry, s.Exit} {
+			if err := a.prepareActions(actions, actionName); err != nil {
+				return err
+			}
+		}
+		for _, t := range s.Transitions {
+			if _, exists := m.States[t.Target]; !exists {
+				return fmt.Errorf("state %s: unknown target state '%s'", name, t.Target)
+			}
+			if len(t.Trigger) == 0 && len(t.Condition) == 0 {
+				return fmt.Errorf("state %s: transition to %s needs a trigger or condition", name, t.Target)
+			}
+			if len(t.Condition) > 0 {
+				if _, err := newExpression(t.Condition, a.messageFunctions(message{}, "")); err != nil {
+					return fmt.Errorf("state %s: %v", name, err)
+				}
+			}
+			if err := a.prepareActions(t.Actions, actionName); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// AddStateMachine adds or replaces a state machine and enters its initial state
+func (a *agent) AddStateMachine(name string, sm StateMachine) {
+	m := &stateMachine{StateMachine: sm, name: name}
+	if err := a.checkStateMachine(m); err != nil {
+		log.WithFields(log.Fields{
+			"component":    "StateMachines",
+			"stateMachine": name,
+		}).Errorf("Invalid state machine: %v", err)
+		return
+	}
+	a.removeStateMachine(name)
+
+	states := make([]interface{}, 0, len(m.States))
+	for state := range m.States {
+		states = append(states, state)
+	}
+	a.SetParameter(m.parameter(), Parameter{Type: TypeString, Enum: states, Publish: true})
+
+	a.machinesMutex.Lock()
+	a.machines[name] = m
+	a.machinesMutex.Unlock()
+	for _, topic := range m.triggers() {
+		if a.ensureSubscription(topic) {
+			a.subscriptions[topic].machines[name] = true
+		}
+	}
+	held := a.holdStateMachineConditions()
+	a.enterState(m, m.Initial, message{})
+	if held {
+		a.releaseStateMachineConditions()
+	}
+}
+
+func (a *agent) removeStateMachine(name string) {
+	a.machinesMutex.Lock()
+	m, exists := a.machines[name]
+	delete(a.machines, name)
+	a.machinesMutex.Unlock()
+	if !exists {
+		return
+	}
+	m.mutex.Lock()
+	if m.timer != nil {
+		m.timer.Stop()
+	}
+	m.mutex.Unlock()
+	for _, topic := range m.triggers() {
+		if _, exists := a.subscriptions[topic]; exists {
+			delete(a.subscriptions[topic].machines, name)
+			a.contemplateUnsubscription(topic)
+		}
+	}
+}
+
+func (a *agent) stateMachine(name string) *stateMachine {
+	a.machinesMutex.Lock()
+	defer a.machinesMutex.Unlock()
+	return a.machines[name]
+}
+
+// handleStateMachineMessage takes the first transition of the current state triggered by
+// filter whose condition is true
+func (a *agent) handleStateMachineMessage(name string, filter string, trigger message) {
+	m := a.stateMachine(name)
+	if m == nil {
+		return
+	}
+	current, entered := m.state()
+	state := m.States[current]
+	held := a.holdStateMachineConditions()
+	if held {
+		defer a.releaseStateMachineConditions()
+	}
+	if filter == EventTopic(stateTimeoutEvent+name) {
+		if trigger.payload == strconv.Itoa(entered) {
+			a.changeState(m, entered, state.TimeoutState, nil, trigger)
+		}
+		return
+	}
+
+	functions := a.messageFunctions(trigger, fmt.Sprintf("executing state machine %s", name))
+	for _, t := range state.Transitions {
+		if t.Trigger != filter {
+			continue
+		}
+		if result, ok := a.evaluateCondition(t.Condition, functions); ok && result {
+			a.changeState(m, entered, t.Target, t.Actions, trigger)
+			return
+		}
+	}
+}
+
+// holdStateMachineConditions defers the evaluation of condition transitions, e.g. while a
+// transition performs its actions. It returns false if they are already held, in which case
+// the caller must not release them.
+func (a *agent) holdStateMachineConditions() bool {
+	a.conditionsMutex.Lock()
+	defer a.conditionsMutex.Unlock()
+	if a.conditionsHeld {
+		return false
+	}
+	a.conditionsHeld = true
+	return true
+}
+
+// releaseStateMachineConditions ends holdStateMachineConditions and evaluates the conditions
+// if parameters changed in the meantime
+func (a *agent) releaseStateMachineConditions() {
+	a.conditionsMutex.Lock()
+	a.conditionsHeld = false
+	pending := a.conditionsPending
+	a.conditionsPending = false
+	a.conditionsMutex.Unlock()
+	if pending {
+		a.evaluateStateMachineConditions()
+	}
+}
+
+// evaluateStateMachineConditions takes the transitions without trigger whose conditions are
+// true. It is called whenever a parameter changes. While conditions are held, the evaluation
+// is left to the holder, so that transitions do not recurse.
+func (a *agent) evaluateStateMachineConditions() {
+	a.conditionsMutex.Lock()
+	if a.conditionsHeld {
+		a.conditionsPending = true
+		a.conditionsMutex.Unlock()
+		return
+	}
+	a.conditionsHeld = true
+	a.conditionsMutex.Unlock()
+
+	for i := 0; ; i++ {
+		changed := a.takeConditionTransitions()
+		a.conditionsMutex.Lock()
+		pending := a.conditionsPending
+		a.conditionsPending = false
+		if (!changed && !pending) || i >= maxTransitionChain {
+			a.conditionsHeld = false
+			a.conditionsMutex.Unlock()
+			return
+		}
+		a.conditionsMutex.Unlock()
+	}
+}
+
+// takeConditionTransitions takes at most one condition transition per state machine and
+// returns true if any was taken
+func (a *agent) takeConditionTransitions() bool {
+	a.machinesMutex.Lock()
+	names := make([]string, 0, len(a.machines))
+	for name := range a.machines {
+		names = append(names, name)
+	}
+	a.machinesMutex.Unlock()
+	sort.Strings(names)
+
+	changed := false
+	for _, name := range names {
+		if m := a.stateMachine(name); m != nil && a.takeConditionTransition(m) {
+			changed = true
+		}
+	}
+	return changed
+}
+
+func (a *agent) takeConditionTransition(m *stateMachine) bool {
+	current, entered := m.state()
+	functions := a.messageFunctions(message{}, fmt.Sprintf("executing state machine %s", m.name))
+	for _, t := range m.States[current].Transitions {
+		if len(t.Trigger) > 0 {
+			continue
+		}
+		if result, ok := a.evaluateCondition(t.Condition, functions); ok && result {
+			return a.changeState(m, entered, t.Target, t.Actions, message{})
+		}
+	}
+	return false
+}
+
+// changeState leaves the current state and enters target, unless the state changed since
+// its sequence number was entered
+func (a *agent) changeState(m *stateMachine, entered int, target string, actions []Action, trigger message) bool {
+	m.mutex.Lock()
+	if m.entered != entered {
+		m.mutex.Unlock()
+		return false
+	}
+	from := m.current
+	m.enter(a, target)
+	m.mutex.Unlock()
+
+	log.WithFields(log.Fields{
+		"component":    "StateMachines",
+		"stateMachine": m.name,
+		"from":         from,
+		"to":           target,
+	}).Debug("State transition")
+
+	functions := a.messageFunctions(trigger, fmt.Sprintf("executing state machine %s", m.name))
+	a.executeActions(m.States[from].Exit, functions, trigger)
+	a.executeActions(actions, functions, trigger)
+	a.enteredState(m, target, trigger)
+	return true
+}
+
+// enterState enters the initial state
+func (a *agent) enterState(m *stateMachine, state string, trigger message) {
+	m.mutex.Lock()
+	m.enter(a, state)
+	m.mutex.Unlock()
+	a.enteredState(m, state, trigger)
+}
+
+// enter makes state the current state and starts its timeout. m.mutex must be held.
+func (m *stateMachine) enter(a *agent, state string) {
+	if m.timer != nil {
+		m.timer.Stop()
+		m.timer = nil
+	}
+	m.current = state
+	m.entered++
+	if s := m.States[state]; s.Timeout > 0 {
+		name, entered := m.name, strconv.Itoa(m.entered)
+		m.timer = time.AfterFunc(time.Duration(s.Timeout*float64(time.Second)), func() {
+			a.raiseEvent(stateTimeoutEvent+name, entered)
+		})
+	}
+}
+
+// enteredState updates the state parameter and performs the entry actions of state
+func (a *agent) enteredState(m *stateMachine, state string, trigger message) {
+	a.SetParameterValue(m.parameter(), state)
+	functions := a.messageFunctions(trigger, fmt.Sprintf("executing state machine %s", m.name))
+	a.executeActions(m.States[state].Entry, functions, trigger)
+}
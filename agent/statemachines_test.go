@@ -0,0 +1,168 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/crenz/mqttrules/test"
+	"github.com/davecgh/go-spew/spew"
+)
+
+const alarmStateMachine = `
+config: {}
+stateMachines:
+  alarm:
+    initial: disarmed
+    states:
+      disarmed:
+        transitions:
+          - trigger: alarm/arm
+            target: arming
+      arming:
+        timeout: 0.1
+        timeoutState: armed
+        entry:
+          - topic: alarm/status
+            payload: arming
+      armed:
+        entry:
+          - topic: alarm/status
+            payload: armed
+        transitions:
+          - trigger: sensors/door
+            condition: payload() == 'open'
+            target: triggered
+          - condition: alarm_code == 1234
+            target: disarmed
+      triggered:
+        exit:
+          - topic: siren/set
+            payload: "off"
+        entry:
+          - topic: siren/set
+            payload: "on ${payload()}"
+        transitions:
+          - condition: alarm_code == 1234
+            target: disarmed
+            actions:
+              - topic: alarm/status
+                payload: disarmed
+`
+
+func TestAgent_StateMachine(t *testing.T) {
+	mqttClient := test.NewClient()
+	a := New(mqttClient, "mr/")
+	mqttClient.SetSubscriptionCallback(nil)
+
+	var c ConfigFile
+	if err := unmarshalFormat([]byte(alarmStateMachine), FormatYAML, &c); err != nil {
+		t.Fatalf("Failed to parse state machine: %v", err)
+	}
+	a.InjectConfigFile(c)
+	if v := a.GetParameterValue("alarm"); v != "disarmed" {
+		t.Errorf("Expected initial state disarmed, got %v", v)
+	}
+	if !mqttClient.IsSubscribed("alarm/arm") || !mqttClient.IsSubscribed("sensors/door") {
+		t.Error("Expected subscriptions to transition triggers")
+	}
+
+	expectMessage := func(step string, topic string, payload string) {
+		if m := mqttClient.LastMessage(); m.Topic != topic || m.Payload != payload {
+			t.Errorf("Unexpected message after %s", step)
+			spew.Dump(m)
+		}
+	}
+
+	a.HandleMessage("sensors/door", []byte("open"))
+	expectMessage("door opened while disarmed", "mr/value/alarm", "disarmed")
+
+	a.HandleMessage("alarm/arm", []byte(""))
+	expectMessage("arming", "alarm/status", "arming")
+	if v := a.GetParameterValue("alarm"); v != "arming" {
+		t.Errorf("Expected state arming, got %v", v)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	a.Listen()
+	expectMessage("timeout", "alarm/status", "armed")
+
+	a.HandleMessage("sensors/door", []byte("closed"))
+	if v := a.GetParameterValue("alarm"); v != "armed" {
+		t.Errorf("Condition should prevent transition, got state %v", v)
+	}
+	a.HandleMessage("sensors/door", []byte("open"))
+	expectMessage("door opened while armed", "siren/set", "on open")
+
+	a.HandleMessage("mr/param/alarm_code", []byte("1234"))
+	expectMessage("entering code", "mr/value/alarm", "disarmed")
+	if v := a.GetParameterValue("alarm"); v != "disarmed" {
+		t.Errorf("Expected state disarmed, got %v", v)
+	}
+}
+
+func TestAgent_StateMachineInvalid(t *testing.T) {
+	a := New(test.NewClient(), "")
+	for name, m := range map[string]StateMachine{
+		"initial": {Initial: "missing", States: map[string]State{"a": {}}},
+		"target":  {Initial: "a", States: map[string]State{"a": {Transitions: []Transition{{Trigger: "t", Target: "b"}}}}},
+		"timeout": {Initial: "a", States: map[string]State{"a": {Timeout: 1}}},
+		"trigger": {Initial: "a", States: map[string]State{"a": {Transitions: []Transition{{Target: "a"}}}}},
+	} {
+		a.AddStateMachine(name, m)
+		if a.(*agent).stateMachine(name) != nil {
+			t.Errorf("Invalid state machine %s should be rejected", name)
+		}
+	}
+}
+
+func TestAgent_StateMachineParameterChange(t *testing.T) {
+	mqttClient := test.NewClient()
+	a := New(mqttClient, "").(*agent)
+	mqttClient.SetSubscriptionCallback(nil)
+
+	a.SetParameter("door", Parameter{Topic: "garage/door", MaxAge: 0.05, StaleValue: "unknown"})
+	a.AddStateMachine("garage", StateMachine{Initial: "idle", States: map[string]State{
+		"idle":  {Transitions: []Transition{{Condition: "door == 'open'", Target: "open"}}},
+		"open":  {Transitions: []Transition{{Condition: "door == 'unknown'", Target: "fault"}}},
+		"fault": {},
+	}})
+
+	// Parameter changes outside of incoming messages
+	a.SetParameterValue("door", "open")
+	if v := a.GetParameterValue("garage"); v != "open" {
+		t.Errorf("Expected state open after parameter change, got %v", v)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if v := a.GetParameterValue("garage"); v != "fault" {
+		t.Errorf("Expected state fault after parameter became stale, got %v", v)
+	}
+}
+
+func TestAgent_StateMachineConcurrent(t *testing.T) {
+	mqttClient := test.NewClient()
+	a := New(mqttClient, "").(*agent)
+	mqttClient.SetSubscriptionCallback(nil)
+
+	toggle := StateMachine{Initial: "off", States: map[string]State{
+		"off": {Transitions: []Transition{{Trigger: "switch", Target: "on"}}},
+		"on":  {Transitions: []Transition{{Trigger: "switch", Target: "off"}, {Condition: "lock == 1", Target: "off"}}},
+	}}
+	a.AddStateMachine("toggle", toggle)
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 50; i++ {
+			a.SetParameterValue("lock", float64(i%2))
+		}
+		done <- true
+	}()
+	for i := 0; i < 50; i++ {
+		a.HandleMessage("switch", []byte(""))
+	}
+	<-done
+
+	m := a.stateMachine("toggle")
+	if current, _ := m.state(); current != a.GetParameterValue("toggle") {
+		t.Errorf("State %s differs from state parameter %v", current, a.GetParameterValue("toggle"))
+	}
+}
@@ -0,0 +1,49 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Version of mqttrules as reported in the status information. Can be set at build time using
+// -ldflags "-X github.com/crenz/mqttrules/agent.Version=1.0.0"
+var Version = "dev"
+
+// Values published to the status topic
+const (
+	StatusOnline  = "online"
+	StatusOffline = "offline"
+)
+
+// StatusTopic returns the topic the agent publishes its online status to. The broker publishes
+// StatusOffline to it via the last will if the connection is lost unexpectedly.
+func StatusTopic(prefix string) string {
+	return fmt.Sprintf("%s$MQTTRULES/status", prefix)
+}
+
+// StatusInfoTopic returns the topic the agent publishes version, start time and rule count to
+func StatusInfoTopic(prefix string) string {
+	return fmt.Sprintf("%s$MQTTRULES/status/info", prefix)
+}
+
+type statusInfo struct {
+	Version                string
+	Started                time.Time
+	Rules                  int
+	InvalidParameterValues uint64
+}
+
+func (a *agent) publishStatus(status string) {
+	a.Publish(StatusTopic(a.prefix), 1, true, status)
+	if status != StatusOnline {
+		return
+	}
+
+	a.rulesMutex.Lock()
+	info := statusInfo{Version, a.started, len(a.rules), atomic.LoadUint64(&a.invalidParameterValues)}
+	a.rulesMutex.Unlock()
+	s, _ := json.Marshal(info)
+	a.Publish(StatusInfoTopic(a.prefix), 1, true, string(s))
+}
@@ -0,0 +1,69 @@
+package agent
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/crenz/mqttrules/test"
+	"github.com/davecgh/go-spew/spew"
+)
+
+func TestAgent_Status(t *testing.T) {
+	mqttClient := test.NewClient()
+	a := New(mqttClient, "mr/")
+
+	a.Connect()
+	m := mqttClient.LastMessage()
+	var info statusInfo
+	if m.Topic != "mr/$MQTTRULES/status/info" || !m.Retained || json.Unmarshal([]byte(m.Payload.(string)), &info) != nil ||
+		info.Version != Version || info.Started.IsZero() || info.Rules != 0 {
+		t.Errorf("Status info not published correctly")
+		spew.Dump(m)
+	}
+
+	c, _ := ConfigFromFile("../test/testConfig.json")
+	a.InjectConfigFile(*c)
+	m = mqttClient.LastMessage()
+	if json.Unmarshal([]byte(m.Payload.(string)), &info) != nil || info.Rules != 2 {
+		t.Errorf("Status info not updated after injecting config file")
+		spew.Dump(m)
+	}
+
+	a.Disconnect()
+	m = mqttClient.LastMessage()
+	if m.Topic != "mr/$MQTTRULES/status" || m.Payload != StatusOffline || !m.Retained {
+		t.Errorf("Offline status not published on disconnect")
+		spew.Dump(m)
+	}
+}
+
+func TestPahoClient_Will(t *testing.T) {
+	broker, err := test.NewBroker(nil)
+	if err != nil {
+		t.Fatalf("Failed to start broker: %v", err)
+	}
+	defer broker.Close()
+
+	c, _ := NewPahoClientFromConfig(Config{Broker: broker.Address(), Prefix: "mr/"})
+	a := New(c, "mr/")
+	if !a.Connect() {
+		t.Fatalf("Failed to connect to broker")
+	}
+	a.Disconnect()
+
+	will := broker.Will()
+	if will == nil || will.Topic != "mr/$MQTTRULES/status" || will.Payload != StatusOffline || !will.Retained {
+		t.Errorf("Last will not set correctly")
+		spew.Dump(will)
+	}
+
+	var statuses []interface{}
+	for _, m := range broker.Messages() {
+		if m.Topic == StatusTopic("mr/") {
+			statuses = append(statuses, m.Payload)
+		}
+	}
+	if len(statuses) != 2 || statuses[0] != StatusOnline || statuses[1] != StatusOffline {
+		t.Errorf("Expected online and offline status, got %v", statuses)
+	}
+}
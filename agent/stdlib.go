@@ -0,0 +1,390 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/Knetic/govaluate"
+)
+
+// standardFunctions are the built-in helper functions available in all expressions
+var standardFunctions = map[string]govaluate.ExpressionFunction{
+	"round":      fRound,
+	"min":        fMin,
+	"max":        fMax,
+	"abs":        fAbs,
+	"clamp":      fClamp,
+	"contains":   fContains,
+	"lower":      fLower,
+	"upper":      fUpper,
+	"split":      fSplit,
+	"replace":    fReplace,
+	"format":     fFormat,
+	"toNumber":   fToNumber,
+	"toString":   fToString,
+	"jsonEncode": fJSONEncode,
+	"len":        fLen,
+	"coalesce":   fCoalesce,
+}
+
+// expressionList carries lists through govaluate, which would otherwise spread a list into the
+// arguments of a function call (e.g. contains(list, x) would receive the list elements and x)
+type expressionList []interface{}
+
+// expressionFunctions wraps functions for use in govaluate expressions, so that they receive
+// lists as a single argument
+func expressionFunctions(functions map[string]govaluate.ExpressionFunction) map[string]govaluate.ExpressionFunction {
+	wrapped := make(map[string]govaluate.ExpressionFunction, len(functions))
+	for name, f := range functions {
+		f := f
+		wrapped[name] = func(args ...interface{}) (interface{}, error) {
+			for i, arg := range args {
+				args[i] = fromExpressionValue(arg)
+			}
+			result, err := f(args...)
+			return toExpressionValue(result), err
+		}
+	}
+	return wrapped
+}
+
+func toExpressionValue(v interface{}) interface{} {
+	if list, isList := v.([]interface{}); isList {
+		return expressionList(list)
+	}
+	return v
+}
+
+func fromExpressionValue(v interface{}) interface{} {
+	if list, isList := v.(expressionList); isList {
+		return []interface{}(list)
+	}
+	return v
+}
+
+// evaluate evaluates an expression parsed by newExpression with the given variables. Lists in
+// values are wrapped in place, so values must not be shared.
+func evaluate(expression *govaluate.EvaluableExpression, values map[string]interface{}) (interface{}, error) {
+	for key, value := range values {
+		values[key] = toExpressionValue(value)
+	}
+	result, err := expression.Evaluate(values)
+	return fromExpressionValue(result), err
+}
+
+func registerStandardFunctions(r *Registry) {
+	for name, f := range standardFunctions {
+		r.RegisterFunction(name, f)
+	}
+}
+
+func checkArgs(name string, args []interface{}, min int, max int) error {
+	if len(args) < min || (max >= 0 && len(args) > max) {
+		switch {
+		case min == max:
+			return fmt.Errorf("%s() expects %d arguments, got %d", name, min, len(args))
+		case max < 0:
+			return fmt.Errorf("%s() expects at least %d arguments, got %d", name, min, len(args))
+		}
+		return fmt.Errorf("%s() expects %d to %d arguments, got %d", name, min, max, len(args))
+	}
+	return nil
+}
+
+// number converts numeric values, numeric strings and booleans to float64
+func number(name string, v interface{}) (float64, error) {
+	switch v := v.(type) {
+	case float64:
+		return v, nil
+	case int:
+		return float64(v), nil
+	case json.Number:
+		return v.Float64()
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return 0, fmt.Errorf("%s(): '%s' is not a number", name, v)
+		}
+		return f, nil
+	}
+	return 0, fmt.Errorf("%s(): %v is not a number", name, v)
+}
+
+func numbers(name string, args []interface{}) ([]float64, error) {
+	values := make([]float64, 0, len(args))
+	for _, arg := range args {
+		if list, isList := arg.([]interface{}); isList {
+			v, err := numbers(name, list)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v...)
+			continue
+		}
+		v, err := number(name, arg)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+func toString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []interface{}, map[string]interface{}:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// round(x) rounds to the nearest integer, round(x, digits) to the given number of decimals
+func fRound(args ...interface{}) (interface{}, error) {
+	if err := checkArgs("round", args, 1, 2); err != nil {
+		return nil, err
+	}
+	values, err := numbers("round", args)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 1 {
+		return math.Round(values[0]), nil
+	}
+	scale := math.Pow(10, math.Trunc(values[1]))
+	return math.Round(values[0]*scale) / scale, nil
+}
+
+func fMin(args ...interface{}) (interface{}, error) {
+	if err := checkArgs("min", args, 1, -1); err != nil {
+		return nil, err
+	}
+	values, err := numbers("min", args)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf("min(): empty list")
+	}
+	result := values[0]
+	for _, v := range values[1:] {
+		result = math.Min(result, v)
+	}
+	return result, nil
+}
+
+func fMax(args ...interface{}) (interface{}, error) {
+	if err := checkArgs("max", args, 1, -1); err != nil {
+		return nil, err
+	}
+	values, err := numbers("max", args)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf("max(): empty list")
+	}
+	result := values[0]
+	for _, v := range values[1:] {
+		result = math.Max(result, v)
+	}
+	return result, nil
+}
+
+func fAbs(args ...interface{}) (interface{}, error) {
+	if err := checkArgs("abs", args, 1, 1); err != nil {
+		return nil, err
+	}
+	v, err := number("abs", args[0])
+	if err != nil {
+		return nil, err
+	}
+	return math.Abs(v), nil
+}
+
+// clamp(x, min, max) limits x to the range [min, max]
+func fClamp(args ...interface{}) (interface{}, error) {
+	if err := checkArgs("clamp", args, 3, 3); err != nil {
+		return nil, err
+	}
+	values, err := numbers("clamp", args)
+	if err != nil {
+		return nil, err
+	}
+	if values[1] > values[2] {
+		return nil, fmt.Errorf("clamp(): minimum %v is greater than maximum %v", values[1], values[2])
+	}
+	return math.Max(values[1], math.Min(values[2], values[0])), nil
+}
+
+// contains(s, substring) checks for a substring; contains(list, value) for an element of a
+// list, e.g. from split() or a JSON array
+func fContains(args ...interface{}) (interface{}, error) {
+	if err := checkArgs("contains", args, 2, 2); err != nil {
+		return nil, err
+	}
+	needle := args[1]
+	switch h := args[0].(type) {
+	case string:
+		return strings.Contains(h, toString(needle)), nil
+	case []string:
+		for _, e := range h {
+			if e == toString(needle) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case []interface{}:
+		for _, e := range h {
+			if reflect.DeepEqual(e, needle) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return nil, fmt.Errorf("contains(): %v is not a string or list", args[0])
+}
+
+func fLower(args ...interface{}) (interface{}, error) {
+	if err := checkArgs("lower", args, 1, 1); err != nil {
+		return nil, err
+	}
+	return strings.ToLower(toString(args[0])), nil
+}
+
+func fUpper(args ...interface{}) (interface{}, error) {
+	if err := checkArgs("upper", args, 1, 1); err != nil {
+		return nil, err
+	}
+	return strings.ToUpper(toString(args[0])), nil
+}
+
+// split(s, separator) returns a list of strings, usable with len() and contains()
+func fSplit(args ...interface{}) (interface{}, error) {
+	if err := checkArgs("split", args, 2, 2); err != nil {
+		return nil, err
+	}
+	return strings.Split(toString(args[0]), toString(args[1])), nil
+}
+
+// replace(s, old, new) replaces all occurrences of old
+func fReplace(args ...interface{}) (interface{}, error) {
+	if err := checkArgs("replace", args, 3, 3); err != nil {
+		return nil, err
+	}
+	return strings.Replace(toString(args[0]), toString(args[1]), toString(args[2]), -1), nil
+}
+
+// format(pattern, args...) formats values like fmt.Sprintf. As all numbers are floating
+// point values, %d formats them rounded to an integer.
+func fFormat(args ...interface{}) (interface{}, error) {
+	if err := checkArgs("format", args, 1, -1); err != nil {
+		return nil, err
+	}
+	pattern, ok := args[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("format(): pattern must be a string")
+	}
+	values := append([]interface{}{}, args[1:]...)
+	for i, verb := range formatVerbs(pattern) {
+		if i >= len(values) {
+			break
+		}
+		if v, isFloat := values[i].(float64); isFloat && verb == 'd' {
+			values[i] = int64(math.Round(v))
+		}
+	}
+	return fmt.Sprintf(pattern, values...), nil
+}
+
+// formatVerbs returns the verbs of a fmt pattern in order, e.g. "dv" for "%3d %v"
+func formatVerbs(pattern string) []rune {
+	var verbs []rune
+	inVerb := false
+	for _, c := range pattern {
+		switch {
+		case !inVerb && c == '%':
+			inVerb = true
+		case inVerb && c == '%':
+			inVerb = false
+		case inVerb && strings.ContainsRune("+-# 0123456789.", c):
+		case inVerb:
+			verbs = append(verbs, c)
+			inVerb = false
+		}
+	}
+	return verbs
+}
+
+func fToNumber(args ...interface{}) (interface{}, error) {
+	if err := checkArgs("toNumber", args, 1, 1); err != nil {
+		return nil, err
+	}
+	return number("toNumber", args[0])
+}
+
+func fToString(args ...interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		// Several arguments are converted as a list
+		return toString(args), nil
+	}
+	return toString(args[0]), nil
+}
+
+func fJSONEncode(args ...interface{}) (interface{}, error) {
+	var v interface{} = args
+	if len(args) == 1 {
+		v = args[0]
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("jsonEncode(): %v", err)
+	}
+	return string(b), nil
+}
+
+// len returns the number of characters of a string or the number of elements of a list or
+// JSON object
+func fLen(args ...interface{}) (interface{}, error) {
+	if err := checkArgs("len", args, 1, 1); err != nil {
+		return nil, err
+	}
+	switch v := args[0].(type) {
+	case string:
+		return float64(utf8.RuneCountInString(v)), nil
+	case []string:
+		return float64(len(v)), nil
+	case []interface{}:
+		return float64(len(v)), nil
+	case map[string]interface{}:
+		return float64(len(v)), nil
+	}
+	return nil, fmt.Errorf("len(): %v is not a string, list or object", args[0])
+}
+
+// coalesce returns the first argument that is neither nil nor an empty string, or an empty
+// string if there is none
+func fCoalesce(args ...interface{}) (interface{}, error) {
+	for _, arg := range args {
+		if s, isString := arg.(string); arg != nil && (!isString || len(s) > 0) {
+			return arg, nil
+		}
+	}
+	return "", nil
+}
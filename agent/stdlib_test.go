@@ -0,0 +1,135 @@
+package agent
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/crenz/mqttrules/test"
+)
+
+func TestStandardFunctions(t *testing.T) {
+	parameters := func() map[string]interface{} {
+		return map[string]interface{}{
+			"temperature": 21.456,
+			"name":        "Kitchen Light",
+			"empty":       "",
+			"list":        []interface{}{1.0, 2.0, 3.0},
+			"single":      []interface{}{"abc"},
+			"object":      map[string]interface{}{"on": true},
+		}
+	}
+
+	for _, c := range []struct {
+		expression string
+		result     interface{}
+	}{
+		{"round(temperature)", 21.0},
+		{"round(temperature, 1)", 21.5},
+		{"round(-2.5)", -3.0},
+		{"min(3, 1, 2)", 1.0},
+		{"min(list)", 1.0},
+		{"max(3, 1, 2)", 3.0},
+		{"max(list)", 3.0},
+		{"max('4', 3)", 4.0},
+		{"abs(-4.5)", 4.5},
+		{"clamp(150, 0, 100)", 100.0},
+		{"clamp(-5, 0, 100)", 0.0},
+		{"clamp(temperature, 0, 100)", 21.456},
+		{"contains(name, 'Light')", true},
+		{"contains(name, 'light')", false},
+		{"contains(split('a,b,c', ','), 'b')", true},
+		{"contains(split('a,b,c', ','), 'd')", false},
+		{"contains(list, 2)", true},
+		{"contains(list, 4)", false},
+		{"contains(single, 'b')", false},
+		{"contains(single, 'abc')", true},
+		{"lower(name)", "kitchen light"},
+		{"upper(name)", "KITCHEN LIGHT"},
+		{"split('a,b,c', ',')", []string{"a", "b", "c"}},
+		{"replace(name, ' ', '_')", "Kitchen_Light"},
+		{"format('%s: %.1f', name, temperature)", "Kitchen Light: 21.5"},
+		{"format('%d%%', 42.4)", "42%"},
+		{"format('%d of %v', 3, 4)", "3 of 4"},
+		{"toNumber('42.5')", 42.5},
+		{"toNumber(true)", 1.0},
+		{"toNumber(' 7 ')", 7.0},
+		{"toString(42)", "42"},
+		{"toString(0.5)", "0.5"},
+		{"toString(true)", "true"},
+		{"jsonEncode(object)", `{"on":true}`},
+		{"jsonEncode(name)", `"Kitchen Light"`},
+		{"len(name)", 13.0},
+		{"len('Grüße')", 5.0},
+		{"len(list)", 3.0},
+		{"len(split('a,b', ','))", 2.0},
+		{"len(object)", 1.0},
+		{"len(single)", 1.0},
+		{"min(list, 0)", 0.0},
+		{"jsonEncode(list)", "[1,2,3]"},
+		{"coalesce(empty, name)", "Kitchen Light"},
+		{"coalesce(empty, '')", ""},
+		{"coalesce(0, 1)", 0.0},
+	} {
+		expression, err := newExpression(c.expression, standardFunctions)
+		if err != nil {
+			t.Errorf("Failed to parse %s: %v", c.expression, err)
+			continue
+		}
+		result, err := evaluate(expression, parameters())
+		if err != nil {
+			t.Errorf("Failed to evaluate %s: %v", c.expression, err)
+			continue
+		}
+		if !reflect.DeepEqual(result, c.result) {
+			t.Errorf("%s == %#v, want %#v", c.expression, result, c.result)
+		}
+	}
+}
+
+func TestStandardFunctions_Errors(t *testing.T) {
+	for _, e := range []string{
+		"round()",
+		"round(1, 2, 3)",
+		"min()",
+		"abs('abc')",
+		"clamp(5, 10, 0)",
+		"toNumber('abc')",
+		"lower('a', 'b')",
+		"format(42)",
+		"len(42)",
+		"len(missing)",
+		"len('a', 'b')",
+		"contains(42, 4)",
+		"contains(object, 'on')",
+	} {
+		expression, err := newExpression(e, standardFunctions)
+		if err != nil {
+			t.Errorf("Failed to parse %s: %v", e, err)
+			continue
+		}
+		if _, err := evaluate(expression, map[string]interface{}{"missing": nil, "object": map[string]interface{}{}}); err == nil {
+			t.Errorf("%s should fail", e)
+		}
+	}
+}
+
+func TestStandardFunctions_Agent(t *testing.T) {
+	mqttClient := test.NewClient()
+	a := New(mqttClient, "")
+	mqttClient.SetSubscriptionCallback(nil)
+
+	a.SetParameterFromString("room", `{"value": "", "topic": "rooms/current", "expression": "upper(coalesce(payload('$.name'), 'unknown'))"}`)
+	a.HandleMessage("rooms/current", []byte(`{"name": "kitchen"}`))
+	if v := a.GetParameterValue("room"); v != "KITCHEN" {
+		t.Errorf("Standard functions not available in parameter expressions, got %v", v)
+	}
+
+	a.AddRuleFromString("climate", "report", `{"trigger": "sensors/temperature",
+		"condition": "contains(lower(room), 'kitchen') && abs(payload()) > 10",
+		"actions": [{"topic": "reports/kitchen", "payload": "${format('%.1f', clamp(payload(), 0, 30))}"}]
+	}`)
+	a.HandleMessage("sensors/temperature", []byte("35.25"))
+	if m := mqttClient.LastMessage(); m.Payload != "30.0" {
+		t.Errorf("Standard functions not available in conditions and templates, got %v", m.Payload)
+	}
+}
@@ -0,0 +1,77 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"text/template"
+
+	"github.com/Knetic/govaluate"
+)
+
+// templateData is available as "." in action templates
+type templateData struct {
+	// Topic and payload of the trigger message
+	Topic   string
+	Payload string
+	// Topic levels matched by the wildcards of the trigger
+	Wildcards []string
+	// Trigger payload parsed as JSON, nil if it is not valid JSON
+	JSON interface{}
+	// Current parameter values
+	Params map[string]interface{}
+}
+
+// templateFunctions makes the expression functions available in templates, e.g.
+// {{payload "$.temperature" | round}}
+func templateFunctions(functions map[string]govaluate.ExpressionFunction) template.FuncMap {
+	funcs := make(template.FuncMap, len(functions))
+	for name, f := range functions {
+		funcs[name] = f
+	}
+	return funcs
+}
+
+// runtimeFunctions are added to the expression functions only while actions are executed,
+// e.g. requestId() by request actions and arg() by scenes. Templates are parsed with stubs for them, as
+// text/template rejects unknown functions.
+var runtimeFunctions = []string{"requestId", "response", "arg"}
+
+// parseTemplate parses an action template; name is used in error messages
+func (a *agent) parseTemplate(name string, text string) (*template.Template, error) {
+	functions := a.messageFunctions(message{}, "")
+	for _, f := range runtimeFunctions {
+		if _, exists := functions[f]; !exists {
+			f := f
+			functions[f] = func(args ...interface{}) (interface{}, error) {
+				return nil, fmt.Errorf("%s() is not available here", f)
+			}
+		}
+	}
+	return template.New(name).Funcs(templateFunctions(functions)).Parse(text)
+}
+
+// renderTemplate executes an action template parsed by parseTemplate for the trigger t
+func (a *agent) renderTemplate(parsed *template.Template, t Trigger, functions map[string]govaluate.ExpressionFunction) (string, error) {
+	if parsed == nil {
+		return "", fmt.Errorf("template has not been parsed")
+	}
+	// The parsed template is shared by concurrent executions, so functions are bound to a copy
+	tmpl, err := parsed.Clone()
+	if err != nil {
+		return "", err
+	}
+	tmpl.Funcs(templateFunctions(functions))
+
+	data := templateData{Topic: t.Topic, Payload: t.Payload, Wildcards: t.Wildcards}
+	if err := json.Unmarshal([]byte(t.Payload), &data.JSON); err != nil {
+		data.JSON = nil
+	}
+	data.Params = a.parameterSnapshot()
+
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
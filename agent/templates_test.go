@@ -0,0 +1,87 @@
+package agent
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/crenz/mqttrules/test"
+	"github.com/davecgh/go-spew/spew"
+)
+
+func TestAgent_Template(t *testing.T) {
+	mqttClient := test.NewClient()
+	a := New(mqttClient, "")
+	mqttClient.SetSubscriptionCallback(nil)
+	a.SetParameter("unit", Parameter{Value: "C"})
+
+	var tests = []struct {
+		name, topic, payload, expectedTopic, expected string
+	}{
+		{"fields", "sensors/{{.JSON.room}}", "{{.Topic}} {{.Payload}}", "sensors/kitchen",
+			`sensors/temp {"room": "kitchen", "values": [21.5, 22.5, 20], "alarm": true}`},
+		{"loop", "out", `{{range $i, $v := .JSON.values}}{{if $i}},{{end}}{{$v}}{{end}}`, "out", "21.5,22.5,20"},
+		{"condition", "out", `{{if .JSON.alarm}}ALARM{{else}}ok{{end}} {{.Params.unit}}`, "out", "ALARM C"},
+		{"functions", "out", `{{payload "$.room" | upper}} {{max .JSON.values}} {{len .JSON.values}}`, "out", "KITCHEN 22.5 3"},
+		{"expression braces", "out", `{{format "{%v}" (round 21.46 1)}}`, "out", "{21.5}"},
+	}
+
+	for _, test := range tests {
+		a.AddRule("templates", test.name, Rule{Trigger: "sensors/temp", Actions: []Action{
+			{Topic: test.topic, Payload: test.payload, Template: true},
+		}})
+		a.HandleMessage("sensors/temp", []byte(`{"room": "kitchen", "values": [21.5, 22.5, 20], "alarm": true}`))
+		a.RemoveRuleSubscription("sensors/temp", "templates", test.name)
+
+		m := mqttClient.LastMessage()
+		if m.Topic != test.expectedTopic || m.Payload != test.expected {
+			t.Errorf("Unexpected message for template %s", test.name)
+			spew.Dump(m)
+		}
+	}
+}
+
+func TestAgent_TemplateInvalid(t *testing.T) {
+	mqttClient := test.NewClient()
+	a := New(mqttClient, "")
+	mqttClient.SetSubscriptionCallback(nil)
+
+	a.AddRule("templates", "invalid", Rule{Actions: []Action{{Topic: "out", Payload: "{{if}}", Template: true}}})
+	if a.GetRule("templates", "invalid") != nil {
+		t.Error("Rule with invalid template should not be added")
+	}
+
+	a.AddRule("templates", "empty", Rule{Actions: []Action{{Topic: "{{if .JSON.missing}}out{{end}}", Payload: "x", Template: true}}})
+	mqttClient.Publish("previous", 0, false, "")
+	a.ExecuteRule("templates", "empty", "{}")
+	if m := mqttClient.LastMessage(); m.Topic != "previous" {
+		t.Error("Message with empty topic should not be published")
+		spew.Dump(m)
+	}
+}
+
+func TestAgent_TemplateRequest(t *testing.T) {
+	mqttClient := test.NewClient()
+	a := New(mqttClient, "").(*agent)
+	mqttClient.SetSubscriptionCallback(func(topic string, payload string) {
+		if topic != "device/command" {
+			return
+		}
+		var request map[string]interface{}
+		json.Unmarshal([]byte(payload), &request)
+		a.messagehandler("device/reply", `{"id": "`+request["id"].(string)+`", "value": 21}`)
+	})
+
+	a.AddRuleFromString("device", "query", `{"actions": [
+		{"topic": "device/command", "payload": "{\"id\": \"{{requestId}}\"}", "template": true,
+		 "replyTopic": "device/reply", "correlationPath": "$.id", "timeout": 1},
+		{"topic": "device/result", "payload": "{{response \"$.value\"}}", "template": true}
+	]}`)
+	if a.GetRule("device", "query") == nil {
+		t.Fatalf("Templates using requestId() and response() should be accepted")
+	}
+	a.ExecuteRule("device", "query", "")
+	if m := mqttClient.LastMessage(); m.Topic != "device/result" || m.Payload != "21" {
+		t.Errorf("Response not available to template")
+		spew.Dump(m)
+	}
+}
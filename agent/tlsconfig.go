@@ -0,0 +1,44 @@
+package agent
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// NewTLSConfig creates the TLS configuration for the broker connection from the CA bundle,
+// client certificate and server verification settings in c. It returns nil if c does not
+// contain any TLS settings.
+func NewTLSConfig(c Config) (*tls.Config, error) {
+	if len(c.CACert) == 0 && len(c.ClientCert) == 0 && len(c.ClientKey) == 0 &&
+		len(c.ServerName) == 0 && !c.InsecureSkipVerify {
+		return nil, nil
+	}
+
+	t := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+
+	if len(c.CACert) > 0 {
+		data, err := ioutil.ReadFile(c.CACert)
+		if err != nil {
+			return nil, err
+		}
+		t.RootCAs = x509.NewCertPool()
+		if !t.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", c.CACert)
+		}
+	}
+
+	if len(c.ClientCert) > 0 || len(c.ClientKey) > 0 {
+		cert, err := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		t.Certificates = []tls.Certificate{cert}
+	}
+
+	return t, nil
+}
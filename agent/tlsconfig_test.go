@@ -0,0 +1,71 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/crenz/mqttrules/test"
+)
+
+func TestNewTLSConfig(t *testing.T) {
+	if c, err := NewTLSConfig(Config{Broker: "tcp://localhost:1883"}); c != nil || err != nil {
+		t.Errorf("NewTLSConfig should return nil without TLS settings")
+	}
+	if _, err := NewTLSConfig(Config{CACert: "missing.pem"}); err == nil {
+		t.Errorf("NewTLSConfig should fail for missing CA bundle")
+	}
+	if _, err := NewTLSConfig(Config{CACert: "../test/testConfig.json"}); err == nil {
+		t.Errorf("NewTLSConfig should fail for CA bundle without certificates")
+	}
+	if _, err := NewTLSConfig(Config{ClientCert: "missing.pem", ClientKey: "missing-key.pem"}); err == nil {
+		t.Errorf("NewTLSConfig should fail for missing client certificate")
+	}
+}
+
+func TestPahoClient_TLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqttrules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certs, err := test.NewCertificates(dir)
+	if err != nil {
+		t.Fatalf("Failed to create certificates: %v", err)
+	}
+	serverTLS, err := certs.ServerTLSConfig()
+	if err != nil {
+		t.Fatalf("Failed to create server TLS config: %v", err)
+	}
+	broker, err := test.NewBroker(serverTLS)
+	if err != nil {
+		t.Fatalf("Failed to start broker: %v", err)
+	}
+	defer broker.Close()
+
+	for _, c := range []struct {
+		name      string
+		config    Config
+		connected bool
+	}{
+		{"mutual TLS", Config{CACert: certs.CACert, ClientCert: certs.ClientCert, ClientKey: certs.ClientKey}, true},
+		{"server name", Config{CACert: certs.CACert, ClientCert: certs.ClientCert, ClientKey: certs.ClientKey, ServerName: "localhost"}, true},
+		{"insecure", Config{ClientCert: certs.ClientCert, ClientKey: certs.ClientKey, InsecureSkipVerify: true}, true},
+		{"no client certificate", Config{CACert: certs.CACert}, false},
+		{"unknown CA", Config{ClientCert: certs.ClientCert, ClientKey: certs.ClientKey, ServerName: "localhost"}, false},
+		{"wrong server name", Config{CACert: certs.CACert, ClientCert: certs.ClientCert, ClientKey: certs.ClientKey, ServerName: "example.com"}, false},
+	} {
+		c.config.Broker = broker.Address()
+		c.config.ClientID = "mqttrules-test"
+		client, err := NewPahoClientFromConfig(c.config)
+		if err != nil {
+			t.Errorf("[%s] Failed to create client: %v", c.name, err)
+			continue
+		}
+		if connected := client.Connect(); connected != c.connected {
+			t.Errorf("[%s] Connect() == %v, want %v", c.name, connected, c.connected)
+		}
+		client.Disconnect()
+	}
+}
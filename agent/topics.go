@@ -0,0 +1,49 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+)
+
+// topicWildcards matches topic against a subscription filter, which may contain the wildcards
+// + and #. It returns the topic levels matched by the wildcards, # matching the remaining
+// levels as one string. As defined by MQTT, topics starting with $ are not matched by a
+// wildcard in the first level.
+func topicWildcards(filter string, topic string) ([]string, bool) {
+	if filter == topic {
+		return nil, true
+	}
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return nil, false
+	}
+
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	var wildcards []string
+	for i := range f {
+		switch {
+		case f[i] == "#":
+			return append(wildcards, strings.Join(t[i:], "/")), true
+		case i >= len(t):
+			return nil, false
+		case f[i] == "+":
+			wildcards = append(wildcards, t[i])
+		case f[i] != t[i]:
+			return nil, false
+		}
+	}
+	return wildcards, len(f) == len(t)
+}
+
+// validatePublishTopic checks that a topic can be published to
+func validatePublishTopic(topic string) error {
+	switch {
+	case len(topic) == 0:
+		return fmt.Errorf("empty topic")
+	case strings.ContainsAny(topic, "+#"):
+		return fmt.Errorf("topic [%s] contains wildcards", topic)
+	case strings.ContainsRune(topic, 0):
+		return fmt.Errorf("topic [%s] contains a null character", topic)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package agent
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/crenz/mqttrules/test"
+	"github.com/davecgh/go-spew/spew"
+)
+
+func TestTopicWildcards(t *testing.T) {
+	var tests = []struct {
+		filter, topic string
+		matches       bool
+		wildcards     []string
+	}{
+		{"home/kitchen/motion", "home/kitchen/motion", true, nil},
+		{"home/kitchen/motion", "home/hall/motion", false, nil},
+		{"home/+/motion", "home/kitchen/motion", true, []string{"kitchen"}},
+		{"home/+/+", "home/kitchen/motion", true, []string{"kitchen", "motion"}},
+		{"home/+", "home/kitchen/motion", false, nil},
+		{"home/+/motion/+", "home/kitchen/motion", false, nil},
+		{"home/#", "home/kitchen/motion", true, []string{"kitchen/motion"}},
+		{"home/+/#", "home/kitchen/motion/1", true, []string{"kitchen", "motion/1"}},
+		{"home/#", "home", true, []string{""}},
+		{"#", "home/kitchen", true, []string{"home/kitchen"}},
+		{"#", "$SYS/uptime", false, nil},
+		{"+/uptime", "$SYS/uptime", false, nil},
+		{"$SYS/+", "$SYS/uptime", true, []string{"uptime"}},
+	}
+
+	for _, test := range tests {
+		wildcards, matches := topicWildcards(test.filter, test.topic)
+		if matches != test.matches || (matches && !reflect.DeepEqual(wildcards, test.wildcards)) {
+			t.Errorf("Unexpected result for filter [%s], topic [%s]: %v %v", test.filter, test.topic, matches, wildcards)
+		}
+	}
+}
+
+func TestValidatePublishTopic(t *testing.T) {
+	for topic, valid := range map[string]bool{
+		"home/kitchen/set": true,
+		"":                 false,
+		"home/+/set":       false,
+		"home/#":           false,
+		"home/a\x00b":      false,
+	} {
+		if err := validatePublishTopic(topic); (err == nil) != valid {
+			t.Errorf("Unexpected validation result for [%s]: %v", topic, err)
+		}
+	}
+}
+
+func TestAgent_WildcardTrigger(t *testing.T) {
+	mqttClient := test.NewClient()
+	a := New(mqttClient, "")
+	mqttClient.SetSubscriptionCallback(nil)
+	a.SetParameter("level", Parameter{Value: 80.0})
+
+	a.AddRuleFromString("lights", "motion", `{
+		"trigger": "home/+/motion/#",
+		"actions": [{"topic": "home/${wildcard(0)}/lights/${payload('$.zone')}/set", "payload": "${level} ${wildcard(1)} ${topic(3)}"}]
+	}`)
+	if !mqttClient.IsSubscribed("home/+/motion/#") {
+		t.Error("Expected subscription to wildcard trigger")
+	}
+
+	a.HandleMessage("home/kitchen/motion/sensor1", []byte(`{"zone": "2"}`))
+	m := mqttClient.LastMessage()
+	if m.Topic != "home/kitchen/lights/2/set" || m.Payload != "80 sensor1 sensor1" {
+		t.Error("Unexpected message for wildcard trigger")
+		spew.Dump(m)
+	}
+
+	// Topics containing wildcards must not be published
+	mqttClient.Publish("previous", 0, false, "")
+	a.HandleMessage("home/kitchen/motion/sensor1", []byte(`{"zone": "+"}`))
+	if m := mqttClient.LastMessage(); m.Topic != "previous" {
+		t.Error("Topic containing wildcards should not be published")
+		spew.Dump(m)
+	}
+
+	a.SetParameterFromString("lastMotion", `{"topic": "home/+/motion/#", "expression": "wildcard(0)"}`)
+	a.HandleMessage("home/hall/motion/sensor2", []byte(`{"zone": "1"}`))
+	if v := a.GetParameterValue("lastMotion"); v != "hall" {
+		t.Errorf("Unexpected value for parameter with wildcard topic: %v", v)
+	}
+}
@@ -0,0 +1,41 @@
+package agent
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// ValueTopic returns the topic the value of a parameter is published to, e.g.
+// value/kitchen/light/state for kitchen.light.state
+func ValueTopic(prefix string, parameter string) string {
+	return fmt.Sprintf("%svalue/%s", prefix, parameterPath(parameter))
+}
+
+// publishesValue returns true if the value of p is published on change
+func (a *agent) publishesValue(p *Parameter) bool {
+	return p.Publish || a.publishParameterValues
+}
+
+// valueChanged checks whether value differs from the last published value by more than the
+// deadband of p, and records it as published if so. paramMutex must be held.
+func (a *agent) valueChanged(name string, p *Parameter, value interface{}) bool {
+	last, published := a.publishedValues[name]
+	if published {
+		if reflect.DeepEqual(last, value) {
+			return false
+		}
+		l, lastIsNumber := last.(float64)
+		v, isNumber := value.(float64)
+		if p.Deadband > 0 && lastIsNumber && isNumber && math.Abs(v-l) < p.Deadband {
+			return false
+		}
+	}
+	a.publishedValues[name] = value
+	return true
+}
+
+// publishValue publishes the current value of a parameter as retained message
+func (a *agent) publishValue(name string, value interface{}) {
+	a.Publish(ValueTopic(a.prefix, name), 1, true, toString(value))
+}
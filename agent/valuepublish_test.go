@@ -0,0 +1,52 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/crenz/mqttrules/test"
+	"github.com/davecgh/go-spew/spew"
+)
+
+func TestAgent_PublishParameterValues(t *testing.T) {
+	mqttClient := test.NewClient()
+	a := New(mqttClient, "mr/")
+	mqttClient.SetSubscriptionCallback(nil)
+
+	a.SetParameterFromString("temperature", `{"value": 20, "topic": "sensors/temperature", "publish": true, "deadband": 0.5}`)
+	if m := mqttClient.LastMessage(); m.Topic != "mr/value/temperature" || m.Payload != "20" || !m.Retained {
+		t.Error("Initial value not published")
+		spew.Dump(m)
+	}
+
+	for _, c := range []struct {
+		payload   string
+		published bool
+	}{
+		{"20.3", false},
+		{"20.5", true},
+		{"20.5", false},
+		{"20.1", false},
+		{"19.9", true},
+	} {
+		mqttClient.Publish("previous", 0, false, "")
+		a.HandleMessage("sensors/temperature", []byte(c.payload))
+		m := mqttClient.LastMessage()
+		if published := m.Topic == "mr/value/temperature"; published != c.published || (published && m.Payload != c.payload) {
+			t.Errorf("Unexpected publishing behaviour for %s", c.payload)
+			spew.Dump(m)
+		}
+	}
+
+	// Parameters without publish are only published if enabled in the configuration
+	mqttClient.Publish("previous", 0, false, "")
+	a.SetParameterFromString("mode", `{"value": "eco"}`)
+	if m := mqttClient.LastMessage(); m.Topic != "previous" {
+		t.Error("Value of parameter without publish should not be published")
+	}
+	a.InjectConfigFile(ConfigFile{Config: Config{PublishParameterValues: true}})
+	a.SetParameterFromString("mode", `{"value": {"heating": "eco"}}`)
+	if m := mqttClient.LastMessage(); m.Topic != "mr/value/mode" || m.Payload != `{"heating":"eco"}` {
+		t.Error("Value not published although enabled in configuration")
+		spew.Dump(m)
+	}
+}
@@ -2,10 +2,12 @@ package main
 
 import (
 	"flag"
+	"os"
+	"os/signal"
+	"syscall"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/crenz/mqttrules/agent"
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/mattn/go-colorable"
 )
 
@@ -25,11 +27,21 @@ func getLogLevel(llString string) log.Level {
 	return level
 }
 
+// expandArgument allows ${ENV:NAME} and ${FILE:path} references in command-line arguments,
+// so that credentials do not need to show up in the process list
+func expandArgument(name string, value string) string {
+	v, err := agent.ExpandSecrets(value)
+	if err != nil {
+		log.Errorf("Error expanding argument %s: %v", name, err)
+	}
+	return v
+}
+
 func main() {
 	pBroker := flag.String("broker", "", "(optional) MQTT broker URI (e.g. tcp://localhost:1883)")
 	pConfigFile := flag.String("config", "", "(optional) configuration file")
 	pUsername := flag.String("username", "", "(optional) user name for MQTT broker access")
-	pPassword := flag.String("password", "", "(optional) password for MQTT broker access")
+	pPassword := flag.String("password", "", "(optional) password for MQTT broker access (may be given as ${ENV:NAME} or ${FILE:path})")
 	pLogLevel := flag.String("loglevel", "", "(optional) logging level (panic, fatal, error, warn, info, debug)")
 
 	flag.Parse()
@@ -48,16 +60,16 @@ func main() {
 
 	// Arguments given via command line have precedence
 	if len(*pBroker) > 0 {
-		c.Config.Broker = *pBroker
+		c.Config.Broker = expandArgument("broker", *pBroker)
 	}
 	if len(c.Config.Broker) == 0 {
 		c.Config.Broker = defaultBroker
 	}
 	if len(*pUsername) > 0 {
-		c.Config.Username = *pUsername
+		c.Config.Username = expandArgument("username", *pUsername)
 	}
 	if len(*pPassword) > 0 {
-		c.Config.Username = *pPassword
+		c.Config.Password = expandArgument("password", *pPassword)
 	}
 	if len(*pLogLevel) > 0 {
 		c.Config.Loglevel = *pLogLevel
@@ -66,12 +78,11 @@ func main() {
 	log.SetLevel(getLogLevel(c.Config.Loglevel))
 
 	log.Infoln("mqtt-rules connecting to broker", c.Config.Broker)
-	opts := mqtt.NewClientOptions()
-	opts.SetClientID(c.Config.ClientID)
-	opts.AddBroker(c.Config.Broker)
-	opts.SetUsername(c.Config.Username)
-	opts.SetPassword(c.Config.Password)
-	mqttClient := agent.NewPahoClient(opts)
+	mqttClient, err := agent.NewClientFromConfig(c.Config)
+	if err != nil {
+		log.Errorf("Error setting up MQTT client: %v", err)
+		return
+	}
 
 	a := agent.New(mqttClient, c.Config.Prefix)
 
@@ -79,9 +90,17 @@ func main() {
 		a.InjectConfigFile(*c)
 		a.Subscribe()
 
+		// Disconnect gracefully, so that the status topic is updated
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-signals
+			a.Disconnect()
+			os.Exit(0)
+		}()
+
 		for {
 			a.Listen()
 		}
-		// will never be reached: c.Disconnect()
 	}
 }
@@ -0,0 +1,125 @@
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"time"
+)
+
+// Certificates holds the paths of a generated CA certificate, server and client certificates
+type Certificates struct {
+	CACert     string
+	ServerCert string
+	ServerKey  string
+	ClientCert string
+	ClientKey  string
+}
+
+// NewCertificates generates a CA plus server and client certificates signed by it, and writes
+// them as PEM files into dir. The server certificate is valid for localhost and 127.0.0.1.
+func NewCertificates(dir string) (*Certificates, error) {
+	c := &Certificates{
+		CACert:     filepath.Join(dir, "ca.pem"),
+		ServerCert: filepath.Join(dir, "server.pem"),
+		ServerKey:  filepath.Join(dir, "server-key.pem"),
+		ClientCert: filepath.Join(dir, "client.pem"),
+		ClientKey:  filepath.Join(dir, "client-key.pem"),
+	}
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mqttrules test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := writePEM(c.CACert, "CERTIFICATE", caDER); err != nil {
+		return nil, err
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+
+	for i, cert := range []struct {
+		certPath, keyPath string
+		template          *x509.Certificate
+	}{
+		{c.ServerCert, c.ServerKey, &x509.Certificate{
+			Subject:     pkix.Name{CommonName: "localhost"},
+			DNSNames:    []string{"localhost"},
+			IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}},
+		{c.ClientCert, c.ClientKey, &x509.Certificate{
+			Subject:     pkix.Name{CommonName: "mqttrules"},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}},
+	} {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		cert.template.SerialNumber = big.NewInt(int64(i + 2))
+		cert.template.NotBefore = caTemplate.NotBefore
+		cert.template.NotAfter = caTemplate.NotAfter
+		cert.template.KeyUsage = x509.KeyUsageDigitalSignature
+		der, err := x509.CreateCertificate(rand.Reader, cert.template, ca, &key.PublicKey, caKey)
+		if err != nil {
+			return nil, err
+		}
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := writePEM(cert.certPath, "CERTIFICATE", der); err != nil {
+			return nil, err
+		}
+		if err := writePEM(cert.keyPath, "EC PRIVATE KEY", keyDER); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// ServerTLSConfig returns a TLS configuration for a broker using the server certificate that
+// requires clients to present a certificate signed by the CA
+func (c *Certificates) ServerTLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.ServerCert, c.ServerKey)
+	if err != nil {
+		return nil, err
+	}
+	caPEM, err := ioutil.ReadFile(c.CACert)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caPEM)
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}, nil
+}
+
+func writePEM(path string, blockType string, der []byte) error {
+	return ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600)
+}
@@ -0,0 +1,459 @@
+package test
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+)
+
+// MockBroker provides a minimal MQTT 3.1.1 and MQTT 5 broker stand-in for testing real client
+// connections. It acknowledges all packets and forwards published messages to matching
+// subscriptions with QoS 0.
+type MockBroker struct {
+	listener net.Listener
+	scheme   string
+
+	mutex       sync.Mutex
+	connections []*brokerConnection
+	connects    int
+	will        *MockMqttMessage
+	messages    []MockMqttMessage
+	aliased     int
+	paused      bool
+	// Reason code and reason string of SUBACK packets sent to MQTT 5 clients
+	subackCode   byte
+	subackReason string
+}
+
+type brokerConnection struct {
+	net.Conn
+	version       byte
+	writeMutex    sync.Mutex
+	subscriptions []string
+	aliases       map[uint16]string
+}
+
+// Number of topic aliases the broker accepts from MQTT 5 clients
+const brokerTopicAliases = 10
+
+// NewBroker starts a mock broker on a random local port. If tlsConfig is given, the broker
+// accepts TLS connections only.
+func NewBroker(tlsConfig *tls.Config) (*MockBroker, error) {
+	b := &MockBroker{scheme: "tcp"}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+		b.scheme = "ssl"
+	}
+	b.listener = l
+
+	go b.accept()
+	return b, nil
+}
+
+// Address returns the broker URI, e.g. tcp://127.0.0.1:1234
+func (b *MockBroker) Address() string {
+	return fmt.Sprintf("%s://%s", b.scheme, b.listener.Addr().String())
+}
+
+// Close stops the broker and drops all client connections
+func (b *MockBroker) Close() {
+	b.listener.Close()
+	b.DropConnections()
+}
+
+// DropConnections closes all client connections without stopping the broker
+func (b *MockBroker) DropConnections() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, conn := range b.connections {
+		conn.Close()
+	}
+	b.connections = nil
+}
+
+// Pause drops all client connections and refuses new ones until Resume is called
+func (b *MockBroker) Pause() {
+	b.mutex.Lock()
+	b.paused = true
+	b.mutex.Unlock()
+	b.DropConnections()
+}
+
+// Resume accepts client connections again after Pause
+func (b *MockBroker) Resume() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.paused = false
+}
+
+// Connects returns the number of CONNECT packets the broker has accepted
+func (b *MockBroker) Connects() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.connects
+}
+
+// Will returns the last will of the most recently connected client, or nil if it has none
+func (b *MockBroker) Will() *MockMqttMessage {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.will
+}
+
+// Messages returns all messages published to the broker
+func (b *MockBroker) Messages() []MockMqttMessage {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]MockMqttMessage{}, b.messages...)
+}
+
+// AliasedMessages returns the number of messages published using only a topic alias
+func (b *MockBroker) AliasedMessages() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.aliased
+}
+
+// SetSubackResponse makes the broker answer subscriptions of MQTT 5 clients with the given
+// reason code (e.g. 0x87 not authorized) and reason string
+func (b *MockBroker) SetSubackResponse(reasonCode byte, reasonString string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.subackCode = reasonCode
+	b.subackReason = reasonString
+}
+
+func (b *MockBroker) accept() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		c := &brokerConnection{Conn: conn, version: 4, aliases: make(map[uint16]string)}
+		b.mutex.Lock()
+		if b.paused {
+			b.mutex.Unlock()
+			conn.Close()
+			continue
+		}
+		b.connections = append(b.connections, c)
+		b.mutex.Unlock()
+		go b.serve(c)
+	}
+}
+
+func (c *brokerConnection) write(p ...byte) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	c.Write(p)
+}
+
+// ack writes a SUBACK or UNSUBACK packet, adding the property list MQTT 5 requires with an
+// optional reason string
+func (c *brokerConnection) ack(header byte, id []byte, reasonString string, reasonCodes ...byte) {
+	body := append([]byte{}, id...)
+	if c.version == 5 {
+		var properties []byte
+		if len(reasonString) > 0 {
+			properties = append([]byte{0x1f, byte(len(reasonString) >> 8), byte(len(reasonString))}, reasonString...)
+		}
+		body = append(append(body, encodeLength(len(properties))...), properties...)
+	}
+	body = append(body, reasonCodes...)
+	c.write(append(append([]byte{header}, encodeLength(len(body))...), body...)...)
+}
+
+// topicFilters returns the topic filters of a SUBSCRIBE or UNSUBSCRIBE packet
+func (c *brokerConnection) topicFilters(body []byte, withOptions bool) []string {
+	var filters []string
+	rest := body[2:]
+	if c.version == 5 {
+		length, n := decodeLength(rest)
+		rest = rest[n+length:]
+	}
+	for len(rest) > 2 {
+		l := int(binary.BigEndian.Uint16(rest))
+		filters = append(filters, string(rest[2:2+l]))
+		rest = rest[2+l:]
+		if withOptions {
+			rest = rest[1:]
+		}
+	}
+	return filters
+}
+
+func (b *MockBroker) serve(c *brokerConnection) {
+	defer c.Close()
+
+	for {
+		header, body, err := readPacket(c)
+		if err != nil {
+			return
+		}
+
+		switch header >> 4 {
+		case 1: // CONNECT
+			c.version = body[2+int(binary.BigEndian.Uint16(body))]
+			b.mutex.Lock()
+			b.connects++
+			b.will = parseWill(body, c.version)
+			b.mutex.Unlock()
+			if c.version == 5 {
+				c.write(0x20, 0x06, 0x00, 0x00, 0x03, 0x22, 0x00, brokerTopicAliases)
+			} else {
+				c.write(0x20, 0x02, 0x00, 0x00)
+			}
+		case 3: // PUBLISH
+			b.handlePublish(c, header, body)
+		case 6: // PUBREL
+			c.write(0x70, 0x02, body[0], body[1])
+		case 8: // SUBSCRIBE
+			filters := c.topicFilters(body, true)
+			b.mutex.Lock()
+			c.subscriptions = append(c.subscriptions, filters...)
+			codes := make([]byte, len(filters))
+			for i := range codes {
+				codes[i] = b.subackCode
+			}
+			reason := b.subackReason
+			b.mutex.Unlock()
+			c.ack(0x90, body[:2], reason, codes...)
+		case 10: // UNSUBSCRIBE
+			filters := c.topicFilters(body, false)
+			b.mutex.Lock()
+			for _, filter := range filters {
+				for i, s := range c.subscriptions {
+					if s == filter {
+						c.subscriptions = append(c.subscriptions[:i], c.subscriptions[i+1:]...)
+						break
+					}
+				}
+			}
+			b.mutex.Unlock()
+			if c.version == 5 {
+				c.ack(0xb0, body[:2], "", make([]byte, len(filters))...)
+			} else {
+				c.write(0xb0, 0x02, body[0], body[1])
+			}
+		case 12: // PINGREQ
+			c.write(0xd0, 0x00)
+		case 14: // DISCONNECT
+			return
+		}
+	}
+}
+
+func (b *MockBroker) handlePublish(c *brokerConnection, header byte, body []byte) {
+	qos := (header >> 1) & 0x03
+	topicLength := int(binary.BigEndian.Uint16(body))
+	topic := string(body[2 : 2+topicLength])
+	rest := body[2+topicLength:]
+
+	var id []byte
+	if qos > 0 {
+		id = rest[:2]
+		rest = rest[2:]
+	}
+	var properties []byte
+	aliased := false
+	if c.version == 5 {
+		var alias uint16
+		length, n := decodeLength(rest)
+		properties, alias = stripTopicAlias(rest[n : n+length])
+		rest = rest[n+length:]
+		if alias > 0 {
+			if len(topic) > 0 {
+				c.aliases[alias] = topic
+			} else {
+				topic = c.aliases[alias]
+				aliased = true
+			}
+		}
+	}
+
+	var subscribers []*brokerConnection
+	b.mutex.Lock()
+	if aliased {
+		b.aliased++
+	}
+	b.messages = append(b.messages, MockMqttMessage{
+		Topic:    topic,
+		QoS:      qos,
+		Retained: header&0x01 != 0,
+		Payload:  string(rest),
+	})
+	for _, s := range b.connections {
+		for _, filter := range s.subscriptions {
+			if TopicMatches(filter, topic) {
+				subscribers = append(subscribers, s)
+				break
+			}
+		}
+	}
+	b.mutex.Unlock()
+
+	// Acknowledge only after recording the message, so that it is visible to tests once the
+	// client considers it delivered
+	switch qos {
+	case 1:
+		c.write(0x40, 0x02, id[0], id[1])
+	case 2:
+		c.write(0x50, 0x02, id[0], id[1])
+	}
+
+	for _, s := range subscribers {
+		s.forward(topic, properties, rest)
+	}
+}
+
+// forward sends a message to a subscriber with QoS 0
+func (c *brokerConnection) forward(topic string, properties []byte, payload []byte) {
+	body := []byte{byte(len(topic) >> 8), byte(len(topic))}
+	body = append(body, topic...)
+	if c.version == 5 {
+		body = append(body, encodeLength(len(properties))...)
+		body = append(body, properties...)
+	}
+	body = append(body, payload...)
+	c.write(append(append([]byte{0x30}, encodeLength(len(body))...), body...)...)
+}
+
+// TopicMatches checks whether topic matches the subscription filter, which may contain the
+// wildcards + and #
+func TopicMatches(filter string, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i := range f {
+		if f[i] == "#" {
+			return true
+		}
+		if i >= len(t) || (f[i] != "+" && f[i] != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+// Sizes of MQTT 5 property values by property identifier; -1 denotes a string or binary value,
+// -2 a string pair and -3 a variable byte integer
+var propertySizes = map[byte]int{
+	0x01: 1, 0x02: 4, 0x03: -1, 0x08: -1, 0x09: -1, 0x0b: -3, 0x11: 4, 0x12: -1, 0x13: 2,
+	0x15: -1, 0x16: -1, 0x17: 1, 0x18: 4, 0x19: 1, 0x1a: -1, 0x1c: -1, 0x1f: -1, 0x21: 2,
+	0x22: 2, 0x23: 2, 0x24: 1, 0x25: 1, 0x26: -2, 0x27: 4, 0x28: 1, 0x29: 1, 0x2a: 1,
+}
+
+// stripTopicAlias removes the topic alias from an MQTT 5 property list and returns it
+func stripTopicAlias(properties []byte) ([]byte, uint16) {
+	var out []byte
+	var alias uint16
+	for i := 0; i < len(properties); {
+		id := properties[i]
+		size := propertySizes[id]
+		switch size {
+		case -1:
+			size = 2 + int(binary.BigEndian.Uint16(properties[i+1:]))
+		case -2:
+			l := 2 + int(binary.BigEndian.Uint16(properties[i+1:]))
+			size = l + 2 + int(binary.BigEndian.Uint16(properties[i+1+l:]))
+		case -3:
+			_, size = decodeLength(properties[i+1:])
+		}
+		if id == 0x23 {
+			alias = binary.BigEndian.Uint16(properties[i+1:])
+		} else {
+			out = append(out, properties[i:i+1+size]...)
+		}
+		i += 1 + size
+	}
+	return out, alias
+}
+
+func parseWill(connect []byte, version byte) *MockMqttMessage {
+	// Protocol name is followed by protocol level and connect flags
+	i := 2 + int(binary.BigEndian.Uint16(connect))
+	flags := connect[i+1]
+	if flags&0x04 == 0 {
+		return nil
+	}
+	readString := func() string {
+		l := int(binary.BigEndian.Uint16(connect[i:]))
+		i += 2 + l
+		return string(connect[i-l : i])
+	}
+	skipProperties := func() {
+		if version == 5 {
+			length, n := decodeLength(connect[i:])
+			i += n + length
+		}
+	}
+	// Skip protocol level, connect flags and keep alive, then connect properties, client ID
+	// and will properties
+	i += 4
+	skipProperties()
+	readString()
+	skipProperties()
+	return &MockMqttMessage{
+		Topic:    readString(),
+		Payload:  readString(),
+		QoS:      (flags >> 3) & 0x03,
+		Retained: flags&0x20 != 0,
+	}
+}
+
+func encodeLength(length int) []byte {
+	var out []byte
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		out = append(out, b)
+		if length == 0 {
+			return out
+		}
+	}
+}
+
+func decodeLength(in []byte) (int, int) {
+	length := 0
+	for i := 0; i < len(in) && i < 4; i++ {
+		length |= int(in[i]&0x7f) << (7 * uint(i))
+		if in[i]&0x80 == 0 {
+			return length, i + 1
+		}
+	}
+	return length, len(in)
+}
+
+func readPacket(r io.Reader) (byte, []byte, error) {
+	var buf [1]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return 0, nil, err
+	}
+	header := buf[0]
+
+	length := 0
+	for shift := uint(0); ; shift += 7 {
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return 0, nil, err
+		}
+		length |= int(buf[0]&0x7f) << shift
+		if buf[0]&0x80 == 0 {
+			break
+		}
+	}
+
+	body := make([]byte, length)
+	_, err := io.ReadFull(r, body)
+	return header, body, err
+}
@@ -1,5 +1,7 @@
 package test
 
+import "sync"
+
 type MockMessageHandler func(topic string, payload string)
 
 // MockMqttClient provides a mock client for testing. Defined to avoid import cycle.
@@ -8,11 +10,13 @@ type MockMqttClient interface {
 	Connect() bool
 	Disconnect()
 	SetSubscriptionCallback(callback func(string, string))
+	SetConnectionCallback(callback func(bool))
 	Publish(topic string, qos byte, retained bool, payload interface{}) bool
 	Subscribe(topic string, qos byte) bool
 	Unsubscribe(topics ...string) bool
 	IsSubscribed(topic string) bool
 	LastMessage() MockMqttMessage
+	SimulateConnectionLoss()
 }
 
 // MockMqttMessage provides a mock MQTT message structure for testing. Defined to avoid import cycle.
@@ -25,9 +29,12 @@ type MockMqttMessage struct {
 
 type mockMqttClient struct {
 	connected     bool
+	lost          bool
 	subscriptions map[string]bool
+	mutex         sync.Mutex
 	lastMessage   MockMqttMessage
 	callback      MockMessageHandler
+	connCallback  func(bool)
 }
 
 func NewClient() MockMqttClient {
@@ -45,9 +52,23 @@ func (c *mockMqttClient) IsConnected() bool {
 
 func (c *mockMqttClient) Connect() bool {
 	c.connected = true
+	// Only reconnects are reported, so tests are not racing against the initial callback
+	if c.lost && c.connCallback != nil {
+		go c.connCallback(true)
+	}
+	c.lost = false
 	return true
 }
 
+// SimulateConnectionLoss marks the client as disconnected and notifies the connection callback
+func (c *mockMqttClient) SimulateConnectionLoss() {
+	c.connected = false
+	c.lost = true
+	if c.connCallback != nil {
+		go c.connCallback(false)
+	}
+}
+
 func (c *mockMqttClient) Disconnect() {
 	c.connected = false
 }
@@ -56,13 +77,19 @@ func (c *mockMqttClient) SetSubscriptionCallback(callback func(string, string))
 	c.callback = callback
 }
 
+func (c *mockMqttClient) SetConnectionCallback(callback func(bool)) {
+	c.connCallback = callback
+}
+
 func (c *mockMqttClient) Publish(topic string, qos byte, retained bool, payload interface{}) bool {
+	c.mutex.Lock()
 	c.lastMessage = MockMqttMessage{
 		Topic:    topic,
 		QoS:      qos,
 		Retained: retained,
 		Payload:  payload,
 	}
+	c.mutex.Unlock()
 
 	if c.callback != nil {
 		go c.callback(topic, payload.(string))
@@ -87,5 +114,7 @@ func (c *mockMqttClient) IsSubscribed(topic string) bool {
 }
 
 func (c *mockMqttClient) LastMessage() MockMqttMessage {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	return c.lastMessage
 }